@@ -48,4 +48,11 @@ Selector labels
 {{- define "k8s-image-warden.selectorLabels" -}}
 app.kubernetes.io/name: {{ include "k8s-image-warden.name" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
-{{- end }}
\ No newline at end of file
+{{- end }}
+
+{{/*
+Whether the controller keeps its store in the SQLite file on the persistent volume
+*/}}
+{{- define "k8s-image-warden.localStore" -}}
+{{- if not (or .Values.controller.storeDSNSecret .Values.controller.inMemoryStore) }}true{{ end }}
+{{- end }}
@@ -9,12 +9,15 @@ import (
 	"github.com/spf13/cobra"
 	k8simagewarden "github.com/surik/k8s-image-warden"
 	"github.com/surik/k8s-image-warden/pkg/agent"
+	"github.com/surik/k8s-image-warden/pkg/health"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
 	"github.com/surik/k8s-image-warden/pkg/signal"
 )
 
 const criEndpointFlag = "container-runtime-endpoint"
 const controllerEndpointFlag = "controller-endpoint"
 const fetchIntervalFlag = "cri-fetch-interval"
+const metricsListeningEndpointFlag = "metrics-listening-endpoint"
 
 var rootCmd = &cobra.Command{
 	Use:     "k8s-image-warder-agent",
@@ -53,9 +56,22 @@ var rootCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
+		metricsListeningEndpoint, err := cmd.Flags().GetString(metricsListeningEndpointFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		metricsServer := metrics.NewServer(metricsListeningEndpoint)
+		metricsServer.Handle("/healthz", health.LivenessHandler())
+		metricsServer.Handle("/readyz", health.NewChecker().Add("agent", agent.Ready).Handler())
+		go metricsServer.Run()
+
 		go agent.Run(ctx)
 
-		signal.WaitForSignals(func() { cancel() }, signal.DefaultWaitTimeout, syscall.SIGINT, syscall.SIGTERM)
+		signal.WaitForSignals(func() {
+			metricsServer.Stop()
+			cancel()
+		}, signal.DefaultWaitTimeout, syscall.SIGINT, syscall.SIGTERM)
 	},
 }
 
@@ -64,6 +80,7 @@ func Execute() {
 	rootCmd.PersistentFlags().String(controllerEndpointFlag, "k8s-image-warden-controller:5000", "The endpoint of image-warden controller")
 	rootCmd.PersistentFlags().Uint16(fetchIntervalFlag, k8simagewarden.DefaultFetchInterval,
 		"How frequently to fetch info from this CRI, in seconds")
+	rootCmd.PersistentFlags().String(metricsListeningEndpointFlag, ":9090", "The HTTP listening endpoint to expose Prometheus metrics and health endpoints on")
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Whoops. There was an error while executing your CLI '%s'", err)
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/surik/k8s-image-warden/pkg/audit"
+	"github.com/surik/k8s-image-warden/pkg/proto"
+)
+
+const (
+	auditFileFlag      = "file"
+	auditPublicKeyFlag = "public-key"
+	auditOutputFlag    = "output"
+	auditFromIDFlag    = "from-id"
+	auditLimitFlag     = "limit"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Subcommand to verify and export audit trail",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify audit trail kept by controller or exported batch given with --file",
+	Run:   auditVerify,
+}
+
+var auditExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export signed batch of audit records",
+	Run:   auditExport,
+}
+
+func auditVerify(cmd *cobra.Command, args []string) {
+	file, err := cmd.Flags().GetString(auditFileFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if file != "" {
+		auditVerifyBatch(cmd, file)
+		return
+	}
+
+	controllerClient, err := connect(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer controllerClient.Stop()
+
+	// verification walks the whole chain, so it may take longer than other requests
+	ctx, cancel := context.WithTimeout(cmd.Context(), 60*time.Second)
+	defer cancel()
+
+	resp, err := controllerClient.VerifyAudit(ctx, &proto.VerifyAuditRequest{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if !resp.Valid {
+		fmt.Printf("Audit trail is broken after %d records: %s\n", resp.Records, resp.Error)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Audit trail is valid, %d records verified\n", resp.Records)
+}
+
+func auditVerifyBatch(cmd *cobra.Command, file string) {
+	publicKeyFile, err := cmd.Flags().GetString(auditPublicKeyFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if publicKeyFile == "" {
+		fmt.Fprintf(os.Stderr, "--%s is required to verify exported batch\n", auditPublicKeyFlag)
+		os.Exit(1)
+	}
+
+	publicKey, err := audit.LoadPublicKey(publicKeyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var batch audit.Batch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := batch.Verify(publicKey); err != nil {
+		fmt.Printf("Batch '%s' is not valid: %s\n", file, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Batch '%s' is valid, %d records verified\n", file, len(batch.Records))
+}
+
+func auditExport(cmd *cobra.Command, args []string) {
+	output, err := cmd.Flags().GetString(auditOutputFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fromID, err := cmd.Flags().GetUint64(auditFromIDFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	limit, err := cmd.Flags().GetInt32(auditLimitFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	controllerClient, err := connect(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer controllerClient.Stop()
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), 60*time.Second)
+	defer cancel()
+
+	resp, err := controllerClient.ExportAudit(ctx, &proto.ExportAuditRequest{FromId: fromID, Limit: limit})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	batch := audit.Batch{
+		Records:   make([]audit.Record, len(resp.Records)),
+		PublicKey: resp.PublicKey,
+		Signature: resp.Signature,
+	}
+	for i, record := range resp.Records {
+		batch.Records[i] = audit.Record{
+			ID:        record.Id,
+			Timestamp: record.Timestamp,
+			Kind:      record.Kind,
+			Data:      record.Data,
+			PrevHash:  record.PrevHash,
+			Hash:      record.Hash,
+		}
+	}
+
+	data, err := json.MarshalIndent(batch, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(output, data, 0o600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(batch.Records) > 0 {
+		fmt.Printf("Exported %d records (%d-%d) to '%s'\n", len(batch.Records),
+			batch.Records[0].ID, batch.Records[len(batch.Records)-1].ID, output)
+	} else {
+		fmt.Println("No records to export")
+	}
+}
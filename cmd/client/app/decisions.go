@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/surik/k8s-image-warden/pkg/proto"
+)
+
+const (
+	decisionsNamespaceFlag = "namespace"
+	decisionsImageFlag     = "image"
+	decisionsVerdictFlag   = "verdict"
+	decisionsModeFlag      = "mode"
+	decisionsSinceFlag     = "since"
+	decisionsLimitFlag     = "limit"
+	decisionsShadowFlag    = "shadow-diff"
+)
+
+var decisionsCmd = &cobra.Command{
+	Use:     "decisions",
+	Aliases: []string{"decision"},
+	Short:   "Subcommand to inspect admission decisions",
+}
+
+var decisionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List validation and mutation decisions made by controller",
+	Run:   decisionsList,
+}
+
+func decisionsList(cmd *cobra.Command, args []string) {
+	req := &proto.GetDecisionsRequest{}
+
+	var err error
+	if req.Namespace, err = cmd.Flags().GetString(decisionsNamespaceFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.Image, err = cmd.Flags().GetString(decisionsImageFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.Verdict, err = cmd.Flags().GetString(decisionsVerdictFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.Mode, err = cmd.Flags().GetString(decisionsModeFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.Limit, err = cmd.Flags().GetInt32(decisionsLimitFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.ShadowDiff, err = cmd.Flags().GetBool(decisionsShadowFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	since, err := cmd.Flags().GetDuration(decisionsSinceFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if since > 0 {
+		req.Since = time.Now().Add(-since).UnixNano()
+	}
+
+	controllerClient, err := connect(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer controllerClient.Stop()
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := controllerClient.GetDecisions(ctx, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(resp.Decisions) == 0 {
+		fmt.Println("No decisions found")
+		return
+	}
+
+	for _, decision := range resp.Decisions {
+		timestamp := time.Unix(0, decision.Timestamp).Format(time.RFC3339)
+
+		object := decision.Object
+		if decision.Namespace != "" {
+			object = decision.Namespace + "/" + object
+		}
+		if decision.Owner != "" {
+			object += " (owned by " + decision.Owner + ")"
+		}
+
+		fmt.Printf("%s %s %s '%s'", timestamp, decision.Mode, decision.Verdict, decision.Image)
+		if decision.Container != "" {
+			fmt.Printf(" container '%s'", decision.Container)
+		}
+		if object != "" {
+			fmt.Printf(" of %s", object)
+		}
+		if decision.Rule != "" {
+			fmt.Printf(" by rule '%s'", decision.Rule)
+		}
+		if decision.Reason != "" {
+			fmt.Printf(": %s", decision.Reason)
+		}
+		if decision.ShadowVerdict != "" {
+			fmt.Printf(" [shadow: %s by rule '%s']", decision.ShadowVerdict, decision.ShadowRule)
+		}
+		fmt.Println()
+	}
+}
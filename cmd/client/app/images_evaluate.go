@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/surik/k8s-image-warden/pkg/proto"
+)
+
+var evaluateCmd = &cobra.Command{
+	Use:   "evaluate",
+	Short: "Mutate and then validate image on the controller, as admission webhooks do",
+	Run:   evaluate,
+}
+
+func evaluate(cmd *cobra.Command, args []string) {
+	controllerClient, err := connect(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer controllerClient.Stop()
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "image reference is required")
+		os.Exit(1)
+	}
+
+	image := args[0]
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := controllerClient.Evaluate(ctx, &proto.EvaluateRequest{Image: image})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(resp.Mutations) == 0 {
+		fmt.Printf("No mutation rules for '%s'\n", image)
+	}
+
+	previous := image
+	for _, step := range resp.Mutations {
+		fmt.Printf("'%s' is mutated to '%s' by rule '%s'\n", previous, step.Image, step.Rule)
+		previous = step.Image
+	}
+
+	if resp.Valid {
+		fmt.Printf("'%s' is valid\n", resp.Image)
+	} else {
+		fmt.Printf("'%s' rejected by rule '%s'\n", resp.Image, resp.Rule)
+	}
+
+	if resp.Reason != "" {
+		fmt.Printf("  reason: %s\n", resp.Reason)
+	}
+}
@@ -12,7 +12,7 @@ import (
 
 var validateCmd = &cobra.Command{
 	Use:   "validate",
-	Short: "Validate image on the controller",
+	Short: "Validate one or more images on the controller",
 	Run:   validate,
 }
 
@@ -29,20 +29,24 @@ func validate(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	image := args[0]
-
 	ctx, cancel := context.WithTimeout(cmd.Context(), 5*time.Second)
 	defer cancel()
 
-	resp, err := controllerClient.Validate(ctx, &proto.ValidateRequest{Image: image})
+	resp, err := controllerClient.ValidateImages(ctx, &proto.ValidateImagesRequest{Images: args})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	if resp.Valid {
-		fmt.Printf("'%s' is valid\n", image)
-	} else {
-		fmt.Printf("'%s' rejected by rule '%s'\n", image, resp.Rule)
+	for _, result := range resp.Results {
+		if result.Valid {
+			fmt.Printf("'%s' is valid\n", result.Image)
+		} else {
+			fmt.Printf("'%s' rejected by rule '%s'\n", result.Image, result.Rule)
+		}
+
+		if result.Reason != "" {
+			fmt.Printf("  reason: %s\n", result.Reason)
+		}
 	}
 }
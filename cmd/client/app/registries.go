@@ -0,0 +1,59 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/surik/k8s-image-warden/pkg/proto"
+)
+
+var registriesCmd = &cobra.Command{
+	Use:     "registries",
+	Aliases: []string{"registry"},
+	Short:   "Show health of registries used by failover rules",
+	Run:     registries,
+}
+
+func registries(cmd *cobra.Command, args []string) {
+	controllerClient, err := connect(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer controllerClient.Stop()
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, err := controllerClient.GetRegistries(ctx, &proto.GetRegistriesRequest{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(resp.Registries) == 0 {
+		fmt.Println("No registries are probed")
+		return
+	}
+
+	for _, registry := range resp.Registries {
+		health := "healthy"
+		if !registry.Healthy {
+			health = "unhealthy"
+		}
+
+		lastChecked := "never"
+		if registry.LastChecked > 0 {
+			lastChecked = time.Unix(0, registry.LastChecked).Format(time.RFC3339)
+		}
+
+		if registry.Error != "" {
+			fmt.Printf("%s %s (last checked: %s) %s\n", registry.Registry, health, lastChecked, registry.Error)
+		} else {
+			fmt.Printf("%s %s (last checked: %s)\n", registry.Registry, health, lastChecked)
+		}
+	}
+}
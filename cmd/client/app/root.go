@@ -47,9 +47,18 @@ func Execute() {
 	imagesCmd.AddCommand(listCmd)
 	imagesCmd.AddCommand(validateCmd)
 	imagesCmd.AddCommand(mutateCmd)
+	imagesCmd.AddCommand(evaluateCmd)
 
 	rootCmd.AddCommand(imagesCmd)
 	rootCmd.AddCommand(rulesCmd)
+	rootCmd.AddCommand(registriesCmd)
+
+	decisionsCmd.AddCommand(decisionsListCmd)
+	rootCmd.AddCommand(decisionsCmd)
+
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditCmd.AddCommand(auditExportCmd)
+	rootCmd.AddCommand(auditCmd)
 
 	kubeconfigPath := filepath.Join(homedir.HomeDir(), ".kube", "config")
 
@@ -59,6 +68,20 @@ func Execute() {
 
 	listCmd.PersistentFlags().Bool(listAllImages, false, "Include all images known by controller")
 
+	decisionsListCmd.Flags().String(decisionsNamespaceFlag, "", "Show only decisions made in the namespace")
+	decisionsListCmd.Flags().String(decisionsImageFlag, "", "Show only decisions for images containing the string")
+	decisionsListCmd.Flags().String(decisionsVerdictFlag, "", "Show only decisions with the verdict: allowed, denied, bypassed, mutated, unchanged or excluded")
+	decisionsListCmd.Flags().String(decisionsModeFlag, "", "Show only decisions made in the mode, e.g. webhook-validate or grpc-mutate")
+	decisionsListCmd.Flags().Duration(decisionsSinceFlag, 0, "Show only decisions made within the duration, e.g. 1h")
+	decisionsListCmd.Flags().Int32(decisionsLimitFlag, 100, "Maximum number of decisions to show, 0 means no limit")
+	decisionsListCmd.Flags().Bool(decisionsShadowFlag, false, "Show only decisions which verdict of the shadow rules differs")
+
+	auditVerifyCmd.Flags().String(auditFileFlag, "", "Verify exported batch instead of audit trail kept by controller")
+	auditVerifyCmd.Flags().String(auditPublicKeyFlag, "", "The path to PEM encoded ed25519 public key of controller to verify exported batch")
+	auditExportCmd.Flags().String(auditOutputFlag, "audit.json", "The path to file to write the batch to")
+	auditExportCmd.Flags().Uint64(auditFromIDFlag, 0, "Export records starting from the ID")
+	auditExportCmd.Flags().Int32(auditLimitFlag, 0, "Maximum number of records to export, 0 means no limit")
+
 	if err := rootCmd.ExecuteContext(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "Whoops. There was an error while executing your CLI '%s'", err)
 		os.Exit(1)
@@ -2,3 +2,10 @@ package k8simagewarden
 
 const DefaultFetchInterval = 10
 const DefaultRetention = 0 // disabled
+const DefaultRegistryProbeInterval = 10
+const DefaultCacheSize = 1024
+const DefaultCacheTTL = 60
+const DefaultRegistryTimeout = 5
+const DefaultCircuitBreakerFailures = 5
+const DefaultCircuitBreakerCooldown = 30
+const DefaultWebhookCertValidity = 365
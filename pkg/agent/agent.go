@@ -2,10 +2,14 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	k8simagewarden "github.com/surik/k8s-image-warden"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
 	"github.com/surik/k8s-image-warden/pkg/proto"
 	"github.com/surik/k8s-image-warden/pkg/runtime"
 	"google.golang.org/grpc"
@@ -21,6 +25,19 @@ type Agent struct {
 	podname            string
 	nodename           string
 	fetchInterval      uint16
+	status             *reportStatus
+}
+
+// maxReportFailures is how many reports in a row may fail before the agent is not ready.
+const maxReportFailures = 3
+
+var ErrReportsFailing = errors.New("reports to controller are failing")
+
+// reportStatus is shared by copies of the agent.
+type reportStatus struct {
+	mu          sync.Mutex
+	failures    int
+	lastSuccess time.Time
 }
 
 func NewAgent(ctx context.Context, criEndpoint, controllerEndpoint, podname, node string, fetchInterval uint16) (*Agent, error) {
@@ -50,6 +67,7 @@ func NewAgent(ctx context.Context, criEndpoint, controllerEndpoint, podname, nod
 		podname:            podname,
 		nodename:           node,
 		fetchInterval:      fetchInterval,
+		status:             &reportStatus{},
 	}, nil
 }
 
@@ -60,7 +78,10 @@ func (agent Agent) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-time.After(time.Duration(agent.fetchInterval) * time.Second):
-			if err := agent.report(ctx); err != nil {
+			err := agent.report(ctx)
+			metrics.AgentReports.WithLabelValues(metrics.Result(err)).Inc()
+			agent.status.observe(err)
+			if err != nil {
 				log.Println(err)
 			}
 		}
@@ -71,17 +92,23 @@ func (agent Agent) report(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	start := time.Now()
 	version, err := agent.RuntimeService.Version(ctx)
+	observeCRI("Version", start, err)
 	if err != nil {
 		return err
 	}
 
+	start = time.Now()
 	images, err := agent.ImageService.ListImages(ctx)
+	observeCRI("ListImages", start, err)
 	if err != nil {
 		return err
 	}
 
+	start = time.Now()
 	fsInfo, err := agent.ImageService.GetFsInfo(ctx)
+	observeCRI("ImageFsInfo", start, err)
 	if err != nil {
 		return err
 	}
@@ -109,3 +136,44 @@ func (agent Agent) report(ctx context.Context) error {
 
 	return nil
 }
+
+// Ready checks that the container runtime responds and reports don't fail repeatedly.
+func (agent Agent) Ready(ctx context.Context) error {
+	if _, err := agent.RuntimeService.Version(ctx); err != nil {
+		return fmt.Errorf("container runtime: %w", err)
+	}
+
+	return agent.status.check()
+}
+
+func (s *reportStatus) observe(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.failures++
+		return
+	}
+
+	s.failures = 0
+	s.lastSuccess = time.Now()
+}
+
+func (s *reportStatus) check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures < maxReportFailures {
+		return nil
+	}
+
+	if s.lastSuccess.IsZero() {
+		return fmt.Errorf("%w: %d in a row, none succeeded", ErrReportsFailing, s.failures)
+	}
+
+	return fmt.Errorf("%w: %d in a row, last succeeded at %s", ErrReportsFailing, s.failures, s.lastSuccess.Format(time.RFC3339))
+}
+
+func observeCRI(call string, start time.Time, err error) {
+	metrics.AgentCRIDuration.WithLabelValues(call, metrics.Result(err)).Observe(time.Since(start).Seconds())
+}
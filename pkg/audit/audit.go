@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	KindDecision   = "decision"
+	KindRules      = "rules"
+	KindCheckpoint = "checkpoint"
+	KindHead       = "head"
+)
+
+var (
+	ErrBrokenChain  = errors.New("audit chain is broken")
+	ErrBadSignature = errors.New("bad audit batch signature")
+	ErrBadKey       = errors.New("bad key")
+)
+
+// Record is a link of the audit chain. Every record carries the hash of the previous one,
+// so editing, reordering or removing a record breaks the chain from that record on.
+type Record struct {
+	ID        uint64 `json:"id"`
+	Timestamp int64  `json:"timestamp"` // in nanoseconds
+	Kind      string `json:"kind"`
+	Data      string `json:"data"`
+	PrevHash  string `json:"prevHash"`
+	Hash      string `json:"hash"`
+}
+
+// ComputeHash returns the hash of the record content chained with the previous hash.
+func (r Record) ComputeHash() string {
+	h := sha256.New()
+	h.Write([]byte(r.PrevHash + "\n"))
+	h.Write([]byte(strconv.FormatInt(r.Timestamp, 10) + "\n"))
+	h.Write([]byte(r.Kind + "\n"))
+	h.Write([]byte(r.Data))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyChain checks that every record matches its hash and points to the previous record.
+// The first record is trusted to point to whatever preceded it, since old records are
+// removed by retention and a batch may start in the middle of the chain.
+func VerifyChain(records []Record) error {
+	for i := range records {
+		var prev *Record
+		if i > 0 {
+			prev = &records[i-1]
+		}
+
+		if err := VerifyNext(prev, records[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyNext checks the record and its link to the previous one, if there is any.
+func VerifyNext(prev *Record, record Record) error {
+	if prev != nil && record.PrevHash != prev.Hash {
+		return fmt.Errorf("%w: record %d doesn't follow record %d", ErrBrokenChain, record.ID, prev.ID)
+	}
+
+	if record.ComputeHash() != record.Hash {
+		return fmt.Errorf("%w: record %d was modified", ErrBrokenChain, record.ID)
+	}
+
+	return nil
+}
+
+// Batch is a signed sequence of records which can be verified without access to the controller.
+type Batch struct {
+	Records   []Record `json:"records"`
+	PublicKey string   `json:"publicKey"`
+	Signature string   `json:"signature"`
+}
+
+// Sign returns a batch of the records signed with the key.
+func Sign(records []Record, key ed25519.PrivateKey) Batch {
+	return Batch{
+		Records:   records,
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, batchDigest(records))),
+	}
+}
+
+// Verify checks the chain of the batch records and the signature. The key embedded into
+// the batch only identifies the signer, the signature is checked against the trusted key.
+func (b Batch) Verify(key ed25519.PublicKey) error {
+	if err := VerifyChain(b.Records); err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadSignature, err)
+	}
+
+	if !ed25519.Verify(key, batchDigest(b.Records), signature) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// batchDigest covers the hashes only, as they already cover the content of verified records.
+func batchDigest(records []Record) []byte {
+	hashes := make([]string, 0, len(records)+1)
+	if len(records) > 0 {
+		hashes = append(hashes, records[0].PrevHash)
+	}
+	for _, record := range records {
+		hashes = append(hashes, record.Hash)
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(hashes, "\n")))
+	return sum[:]
+}
+
+// Head is the data of an audit record of kind head, which signs the record it follows. The hash of a record
+// covers all records before it, so rewriting any of them needs the signing key, not only access to the store.
+type Head struct {
+	ID        uint64 `json:"id"`
+	Hash      string `json:"hash"`
+	Signature string `json:"signature"`
+}
+
+// SignHead returns the head signing the record with the key.
+func SignHead(record Record, key ed25519.PrivateKey) Head {
+	return Head{
+		ID:        record.ID,
+		Hash:      record.Hash,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, headDigest(record.ID, record.Hash))),
+	}
+}
+
+// Verify checks that the head signs the record with the given hash, i.e. the previous hash of the head record.
+func (h Head) Verify(prevHash string, key ed25519.PublicKey) error {
+	if h.Hash != prevHash {
+		return fmt.Errorf("%w: head doesn't sign the record it follows", ErrBadSignature)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(h.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadSignature, err)
+	}
+
+	if !ed25519.Verify(key, headDigest(h.ID, h.Hash), signature) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+func headDigest(id uint64, hash string) []byte {
+	sum := sha256.Sum256([]byte(strconv.FormatUint(id, 10) + "\n" + hash))
+	return sum[:]
+}
+
+// LoadPrivateKey reads PEM encoded PKCS #8 ed25519 private key.
+func LoadPrivateKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadKey, err)
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an ed25519 private key", ErrBadKey)
+	}
+
+	return privateKey, nil
+}
+
+// LoadPublicKey reads PEM encoded PKIX ed25519 public key.
+func LoadPublicKey(file string) (ed25519.PublicKey, error) {
+	der, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadKey, err)
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an ed25519 public key", ErrBadKey)
+	}
+
+	return publicKey, nil
+}
+
+func readPEM(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data in %s", ErrBadKey, file)
+	}
+
+	return block.Bytes, nil
+}
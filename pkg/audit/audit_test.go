@@ -0,0 +1,123 @@
+package audit_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/audit"
+)
+
+func newChain(t *testing.T, data ...string) []audit.Record {
+	t.Helper()
+
+	records := make([]audit.Record, len(data))
+	prevHash := ""
+	for i := range data {
+		records[i] = audit.Record{
+			ID:        uint64(i + 1),
+			Timestamp: int64(i + 1),
+			Kind:      audit.KindDecision,
+			Data:      data[i],
+			PrevHash:  prevHash,
+		}
+		records[i].Hash = records[i].ComputeHash()
+		prevHash = records[i].Hash
+	}
+
+	return records
+}
+
+func TestVerifyChain(t *testing.T) {
+	records := newChain(t, "a", "b", "c")
+	require.NoError(t, audit.VerifyChain(records))
+
+	// chain may start in the middle
+	require.NoError(t, audit.VerifyChain(records[1:]))
+
+	// modified record
+	modified := newChain(t, "a", "b", "c")
+	modified[1].Data = "x"
+	require.ErrorIs(t, audit.VerifyChain(modified), audit.ErrBrokenChain)
+
+	// modified record with recomputed hash doesn't match the next one
+	modified[1].Hash = modified[1].ComputeHash()
+	require.ErrorIs(t, audit.VerifyChain(modified), audit.ErrBrokenChain)
+
+	// removed record
+	removed := []audit.Record{records[0], records[2]}
+	require.ErrorIs(t, audit.VerifyChain(removed), audit.ErrBrokenChain)
+}
+
+func TestBatch(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	batch := audit.Sign(newChain(t, "a", "b"), privateKey)
+	require.NoError(t, batch.Verify(publicKey))
+
+	// batch signed by another key
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, batch.Verify(otherKey), audit.ErrBadSignature)
+
+	// the last record replaced with a valid link of another chain
+	forged := audit.Sign(newChain(t, "a", "b"), privateKey)
+	forged.Records = newChain(t, "a", "c")
+	require.ErrorIs(t, forged.Verify(publicKey), audit.ErrBadSignature)
+}
+
+func TestHead(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	records := newChain(t, "a", "b")
+	head := audit.SignHead(records[1], privateKey)
+	require.NoError(t, head.Verify(records[1].Hash, publicKey))
+
+	// head signed by another key
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, head.Verify(records[1].Hash, otherKey), audit.ErrBadSignature)
+
+	// the chain rewritten up to the head
+	forged := newChain(t, "a", "c")
+	require.ErrorIs(t, head.Verify(forged[1].Hash, publicKey), audit.ErrBadSignature)
+
+	// the signed hash replaced as well
+	head.Hash = forged[1].Hash
+	require.ErrorIs(t, head.Verify(forged[1].Hash, publicKey), audit.ErrBadSignature)
+}
+
+func TestLoadKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	privateKeyFile := path.Join(dir, "audit.key")
+	require.NoError(t, os.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	der, err = x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	publicKeyFile := path.Join(dir, "audit.pub")
+	require.NoError(t, os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	loadedPrivateKey, err := audit.LoadPrivateKey(privateKeyFile)
+	require.NoError(t, err)
+	require.Equal(t, privateKey, loadedPrivateKey)
+
+	loadedPublicKey, err := audit.LoadPublicKey(publicKeyFile)
+	require.NoError(t, err)
+	require.Equal(t, publicKey, loadedPublicKey)
+
+	_, err = audit.LoadPrivateKey(publicKeyFile)
+	require.ErrorIs(t, err, audit.ErrBadKey)
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/metrics"
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache is a size bounded LRU cache which entries expire after TTL. Concurrent loads
+// of the same key are merged, so only one of them reaches the loader.
+type Cache[V any] struct {
+	name  string
+	size  int
+	ttl   time.Duration
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+	group singleflight.Group
+	now   func() time.Time
+}
+
+type entry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+// New creates a cache, the name is used as the metrics label.
+func New[V any](name string, size int, ttl time.Duration) *Cache[V] {
+	return &Cache[V]{
+		name:  name,
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+		now:   time.Now,
+	}
+}
+
+// Get returns the cached value or loads it. Errors are not cached. The load is shared by
+// concurrent callers, so it runs without cancellation of the caller which started it and
+// must bound itself. A caller whose context is done stops waiting for the load.
+func (c *Cache[V]) Get(ctx context.Context, key string, load func(ctx context.Context) (V, error)) (V, error) {
+	if value, ok := c.get(key); ok {
+		metrics.CacheRequests.WithLabelValues(c.name, metrics.CacheHit).Inc()
+		return value, nil
+	}
+
+	metrics.CacheRequests.WithLabelValues(c.name, metrics.CacheMiss).Inc()
+
+	loadCtx := context.WithoutCancel(ctx)
+	results := c.group.DoChan(key, func() (interface{}, error) {
+		value, err := load(loadCtx)
+		if err != nil {
+			return value, err
+		}
+
+		c.set(key, value)
+		return value, nil
+	})
+
+	select {
+	case res := <-results:
+		result, _ := res.Val.(V)
+		return result, res.Err
+	case <-ctx.Done():
+		var empty V
+		return empty, ctx.Err()
+	}
+}
+
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *Cache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var empty V
+
+	elem, ok := c.items[key]
+	if !ok {
+		return empty, false
+	}
+
+	item := elem.Value.(*entry[V])
+	if !c.now().Before(item.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		return empty, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return item.value, true
+}
+
+func (c *Cache[V]) set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(c.ttl)
+
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*entry[V])
+		item.value = value
+		item.expiresAt = expiresAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&entry[V]{key: key, value: value, expiresAt: expiresAt})
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry[V]).key)
+	}
+}
@@ -0,0 +1,144 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/cache"
+	helpers "github.com/surik/k8s-image-warden/pkg/metrics/testing"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := cache.New[string]("test", 2, time.Minute)
+
+	now := time.Now()
+	c.SetNow(func() time.Time { return now })
+
+	loads := 0
+	load := func(value string) func(context.Context) (string, error) {
+		return func(context.Context) (string, error) {
+			loads++
+			return value, nil
+		}
+	}
+
+	value, err := c.Get(ctx, "a", load("1"))
+	require.NoError(t, err)
+	require.Equal(t, "1", value)
+
+	// cached value is returned
+	value, err = c.Get(ctx, "a", load("2"))
+	require.NoError(t, err)
+	require.Equal(t, "1", value)
+	require.Equal(t, 1, loads)
+
+	// the least recently used key is evicted
+	_, err = c.Get(ctx, "b", load("1"))
+	require.NoError(t, err)
+	_, err = c.Get(ctx, "a", load("1"))
+	require.NoError(t, err)
+	_, err = c.Get(ctx, "c", load("1"))
+	require.NoError(t, err)
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, 3, loads)
+
+	_, err = c.Get(ctx, "b", load("1"))
+	require.NoError(t, err)
+	require.Equal(t, 4, loads)
+
+	// expired value is loaded again
+	now = now.Add(time.Minute)
+	value, err = c.Get(ctx, "b", load("3"))
+	require.NoError(t, err)
+	require.Equal(t, "3", value)
+	require.Equal(t, 5, loads)
+
+	// errors are not cached
+	_, err = c.Get(ctx, "d", func(context.Context) (string, error) { return "", errors.New("unavailable") })
+	require.Error(t, err)
+	value, err = c.Get(ctx, "d", load("4"))
+	require.NoError(t, err)
+	require.Equal(t, "4", value)
+
+	body := helpers.Scrape(t)
+	require.Contains(t, body, `kiw_cache_requests_total{cache="test",result="hit"} 2`)
+	require.Contains(t, body, `kiw_cache_requests_total{cache="test",result="miss"} 7`)
+}
+
+func TestCache_Singleflight(t *testing.T) {
+	c := cache.New[string]("singleflight", 10, time.Minute)
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			value, err := c.Get(context.Background(), "a", func(context.Context) (string, error) {
+				loads.Add(1)
+				<-release
+				return "1", nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, "1", value)
+		}()
+	}
+
+	// let all goroutines to reach the cache before the load is done
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), loads.Load())
+}
+
+func TestCache_Cancel(t *testing.T) {
+	c := cache.New[string]("cancel", 10, time.Minute)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	load := func(ctx context.Context) (string, error) {
+		close(started)
+		select {
+		case <-release:
+			return "1", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	// the caller which started the load goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := c.Get(ctx, "a", load)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan string)
+	go func() {
+		value, err := c.Get(context.Background(), "a", load)
+		require.NoError(t, err)
+		second <- value
+	}()
+
+	// let the second caller to join the load
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-first, context.Canceled)
+
+	// the load goes on for the other caller
+	close(release)
+	require.Equal(t, "1", <-second)
+	require.Equal(t, 1, c.Len())
+}
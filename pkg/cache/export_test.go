@@ -0,0 +1,7 @@
+package cache
+
+import "time"
+
+func (c *Cache[V]) SetNow(now func() time.Time) {
+	c.now = now
+}
@@ -0,0 +1,145 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var ErrBadCertificate = errors.New("bad certificate")
+
+// backdate covers clock skew between the controller and the API server.
+const backdate = time.Hour
+
+// KeyPair is a PEM encoded certificate and its private key.
+type KeyPair struct {
+	Cert []byte
+	Key  []byte
+}
+
+// NewCA returns self-signed CA certificate valid for the validity from now.
+func NewCA(commonName string, now time.Time, validity time.Duration) (KeyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	return newKeyPair(template, nil, nil)
+}
+
+// NewServingCert returns serving certificate for the DNS names signed by the CA.
+func NewServingCert(ca KeyPair, dnsNames []string, now time.Time, validity time.Duration) (KeyPair, error) {
+	caCert, err := ParseCert(ca.Cert)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	caKey, err := parseKey(ca.Key)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	var commonName string
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-backdate),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	return newKeyPair(template, caCert, caKey)
+}
+
+// TLSCertificate returns the key pair usable by TLS server.
+func (p KeyPair) TLSCertificate() (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(p.Cert, p.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// ParseCert returns the first certificate of PEM data.
+func ParseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: no PEM encoded certificate", ErrBadCertificate)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM encoded key", ErrBadCertificate)
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// newKeyPair signs the template by the parent, the certificate is self-signed if there is no parent.
+func newKeyPair(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (KeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	return KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// concat joins PEM data skipping empty ones.
+func concat(data ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, d := range data {
+		if len(d) == 0 {
+			continue
+		}
+		buf.Write(bytes.TrimSpace(d))
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,7 @@
+package certs
+
+import "time"
+
+func (m *Manager) SetNow(now func() time.Time) {
+	m.now = now
+}
@@ -0,0 +1,90 @@
+package certs
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileProvider serves the certificate from files and reloads it once the files are changed,
+// e.g. when cert-manager renews the mounted secret.
+type FileProvider struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewFileProvider(certFile, keyFile string) (*FileProvider, error) {
+	p := &FileProvider{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate. The previous certificate
+// is served if the changed files can't be loaded, as they may be replaced one by one.
+func (p *FileProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	modTime, err := p.lastModified()
+	if err == nil && !modTime.Equal(p.modTime) {
+		if err := p.load(modTime); err != nil {
+			log.Printf("error when reloading webhook certificate: %s", err)
+		}
+	}
+
+	return p.cert, nil
+}
+
+func (p *FileProvider) reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	modTime, err := p.lastModified()
+	if err != nil {
+		return err
+	}
+
+	return p.load(modTime)
+}
+
+func (p *FileProvider) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return err
+	}
+
+	p.cert = &cert
+	p.modTime = modTime
+	log.Printf("webhook certificate is loaded from %s\n", p.certFile)
+
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and the key files.
+func (p *FileProvider) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{p.certFile, p.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
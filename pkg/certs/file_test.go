@@ -0,0 +1,61 @@
+package certs_test
+
+import (
+	"crypto/tls"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/certs"
+)
+
+func writeKeyPair(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+
+	ca, err := certs.NewCA("test", time.Now(), time.Hour)
+	require.NoError(t, err)
+
+	pair, err := certs.NewServingCert(ca, []string{"localhost"}, time.Now(), time.Hour)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pair.Cert, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pair.Key, 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := path.Join(dir, "tls.crt"), path.Join(dir, "tls.key")
+
+	_, err := certs.NewFileProvider(certFile, keyFile)
+	require.Error(t, err)
+
+	modTime := time.Now().Add(-time.Minute)
+	writeKeyPair(t, certFile, keyFile, modTime)
+
+	provider, err := certs.NewFileProvider(certFile, keyFile)
+	require.NoError(t, err)
+
+	first, err := provider.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+
+	// unchanged files are not reloaded
+	same, err := provider.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Same(t, first, same)
+
+	// changed files are reloaded
+	writeKeyPair(t, certFile, keyFile, time.Now())
+	renewed, err := provider.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.NotEqual(t, first.Certificate, renewed.Certificate)
+
+	// broken files keep the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("broken"), 0o600))
+	kept, err := provider.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Same(t, renewed, kept)
+}
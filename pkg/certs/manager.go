@@ -0,0 +1,289 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// keys of the secret in addition to tls.crt and tls.key
+const (
+	SecretCACert         = "ca.crt"
+	SecretCAKey          = "ca.key"
+	SecretPreviousCACert = "ca-previous.crt"
+)
+
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// attempts to ensure certificates when other replicas change the secret at the same time
+const ensureAttempts = 3
+
+var ErrNoCertificate = errors.New("no webhook certificate")
+
+type Config struct {
+	Namespace  string
+	SecretName string
+	// WebhookConfiguration is the name of mutating and validating webhook configurations to inject CA bundle into.
+	WebhookConfiguration string
+	DNSNames             []string
+	// Validity of the serving certificate, it is renewed when less than a third of it is left.
+	Validity      time.Duration
+	CheckInterval time.Duration
+}
+
+// Manager keeps the CA and the serving certificate of the webhook in a secret, renews them
+// before they expire and makes the webhook configurations trust the CA. All replicas of the
+// controller share the secret and pick up certificates renewed by others on the next check.
+type Manager struct {
+	client kubernetes.Interface
+	config Config
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	now    func() time.Time
+	doneCh chan bool
+}
+
+func NewManager(client kubernetes.Interface, config Config) *Manager {
+	return &Manager{
+		client: client,
+		config: config,
+		now:    time.Now,
+		doneCh: make(chan bool),
+	}
+}
+
+func (m *Manager) Run() {
+	go func() {
+		for {
+			select {
+			case <-m.doneCh:
+				return
+			case <-time.After(m.config.CheckInterval):
+				if err := m.Ensure(context.Background()); err != nil {
+					log.Printf("error when ensuring webhook certificate: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+func (m *Manager) Stop() {
+	m.doneCh <- true
+	log.Println("Certificate Manager was shutdown")
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return nil, ErrNoCertificate
+	}
+
+	return m.cert, nil
+}
+
+// Ensure renews certificates of the secret if needed, serves the certificate from the secret
+// and injects the CA bundle into the webhook configurations.
+func (m *Manager) Ensure(ctx context.Context) error {
+	var err error
+	for attempt := 0; attempt < ensureAttempts; attempt++ {
+		err = m.ensure(ctx)
+		if !apierrors.IsConflict(err) && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (m *Manager) ensure(ctx context.Context) error {
+	secrets := m.client.CoreV1().Secrets(m.config.Namespace)
+
+	secret, err := secrets.Get(ctx, m.config.SecretName, metav1.GetOptions{})
+	exists := err == nil
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: m.config.SecretName, Namespace: m.config.Namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	renewed, err := m.renew(secret)
+	if err != nil {
+		return err
+	}
+
+	if renewed {
+		if exists {
+			secret, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		} else {
+			secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("webhook certificate is renewed in secret %s/%s\n", m.config.Namespace, m.config.SecretName)
+	}
+
+	serving := KeyPair{Cert: secret.Data[corev1.TLSCertKey], Key: secret.Data[corev1.TLSPrivateKeyKey]}
+	cert, err := serving.TLSCertificate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+
+	return m.injectCABundle(ctx, m.caBundle(secret))
+}
+
+// renew replaces certificates of the secret which are invalid or expire soon. The previous CA
+// stays in the CA bundle until it expires, so replicas serving the old certificate are trusted.
+func (m *Manager) renew(secret *corev1.Secret) (bool, error) {
+	now := m.now()
+
+	ca := KeyPair{Cert: secret.Data[SecretCACert], Key: secret.Data[SecretCAKey]}
+	serving := KeyPair{Cert: secret.Data[corev1.TLSCertKey], Key: secret.Data[corev1.TLSPrivateKeyKey]}
+
+	caValid := m.isValid(ca, caValidity, nil)
+	if caValid && m.isValid(serving, m.config.Validity, ca.Cert) {
+		return false, nil
+	}
+
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	if !caValid {
+		newCA, err := NewCA(m.config.SecretName, now, caValidity)
+		if err != nil {
+			return false, err
+		}
+
+		delete(secret.Data, SecretPreviousCACert)
+		if _, err := ca.TLSCertificate(); err == nil {
+			secret.Data[SecretPreviousCACert] = ca.Cert
+		}
+
+		ca = newCA
+		secret.Data[SecretCACert] = ca.Cert
+		secret.Data[SecretCAKey] = ca.Key
+	}
+
+	serving, err := NewServingCert(ca, m.config.DNSNames, now, m.config.Validity)
+	if err != nil {
+		return false, err
+	}
+
+	secret.Data[corev1.TLSCertKey] = serving.Cert
+	secret.Data[corev1.TLSPrivateKeyKey] = serving.Key
+
+	return true, nil
+}
+
+// isValid checks that the key pair matches, is not going to expire soon and, if the CA
+// is given, is signed by the CA. Serving certificate also has to be issued for all DNS names.
+func (m *Manager) isValid(pair KeyPair, validity time.Duration, caCert []byte) bool {
+	if _, err := pair.TLSCertificate(); err != nil {
+		return false
+	}
+
+	cert, err := ParseCert(pair.Cert)
+	if err != nil {
+		return false
+	}
+
+	if cert.NotAfter.Sub(m.now()) < validity/3 {
+		return false
+	}
+
+	if caCert == nil {
+		return true
+	}
+
+	ca, err := ParseCert(caCert)
+	if err != nil || cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+
+	return slices.Equal(cert.DNSNames, m.config.DNSNames)
+}
+
+// caBundle returns the current CA and the previous one while it is not expired.
+func (m *Manager) caBundle(secret *corev1.Secret) []byte {
+	previous, err := ParseCert(secret.Data[SecretPreviousCACert])
+	if err != nil || m.now().After(previous.NotAfter) {
+		return concat(secret.Data[SecretCACert])
+	}
+
+	return concat(secret.Data[SecretCACert], secret.Data[SecretPreviousCACert])
+}
+
+// injectCABundle updates webhooks of the configurations which don't trust the CA bundle yet.
+// Missing configurations are skipped, e.g. when only one of the webhooks is installed.
+func (m *Manager) injectCABundle(ctx context.Context, bundle []byte) error {
+	if m.config.WebhookConfiguration == "" {
+		return nil
+	}
+
+	mutatingConfigs := m.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	mutating, err := mutatingConfigs.Get(ctx, m.config.WebhookConfiguration, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		changed := false
+		for i := range mutating.Webhooks {
+			if !bytes.Equal(mutating.Webhooks[i].ClientConfig.CABundle, bundle) {
+				mutating.Webhooks[i].ClientConfig.CABundle = bundle
+				changed = true
+			}
+		}
+
+		if changed {
+			if _, err := mutatingConfigs.Update(ctx, mutating, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			log.Printf("CA bundle is injected into mutating webhook configuration %s\n", mutating.Name)
+		}
+	}
+
+	validatingConfigs := m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	validating, err := validatingConfigs.Get(ctx, m.config.WebhookConfiguration, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		changed := false
+		for i := range validating.Webhooks {
+			if !bytes.Equal(validating.Webhooks[i].ClientConfig.CABundle, bundle) {
+				validating.Webhooks[i].ClientConfig.CABundle = bundle
+				changed = true
+			}
+		}
+
+		if changed {
+			if _, err := validatingConfigs.Update(ctx, validating, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			log.Printf("CA bundle is injected into validating webhook configuration %s\n", validating.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/certs"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	namespace     = "kiw"
+	secretName    = "kiw-webhook-server-tls"
+	configuration = "kiw-controller"
+	dnsName       = "kiw-controller.kiw.svc"
+)
+
+func newClient() *fake.Clientset {
+	return fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: configuration},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mutate." + dnsName}},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: configuration},
+			Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validate." + dnsName}},
+		},
+	)
+}
+
+func newManager(client *fake.Clientset, now *time.Time) *certs.Manager {
+	manager := certs.NewManager(client, certs.Config{
+		Namespace:            namespace,
+		SecretName:           secretName,
+		WebhookConfiguration: configuration,
+		DNSNames:             []string{dnsName},
+		Validity:             30 * 24 * time.Hour,
+		CheckInterval:        time.Hour,
+	})
+	manager.SetNow(func() time.Time { return *now })
+
+	return manager
+}
+
+func getSecret(t *testing.T, client *fake.Clientset) *corev1.Secret {
+	t.Helper()
+
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
+	require.NoError(t, err)
+	return secret
+}
+
+func getCABundles(t *testing.T, client *fake.Clientset) ([]byte, []byte) {
+	t.Helper()
+
+	mutating, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), configuration, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), configuration, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	return mutating.Webhooks[0].ClientConfig.CABundle, validating.Webhooks[0].ClientConfig.CABundle
+}
+
+func verify(t *testing.T, manager *certs.Manager, caBundle []byte) {
+	t.Helper()
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caBundle))
+
+	// chain is verified at the time the certificate was issued
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: dnsName, CurrentTime: leaf.NotBefore.Add(time.Hour)})
+	require.NoError(t, err)
+}
+
+func TestManager(t *testing.T) {
+	client := newClient()
+	now := time.Now()
+	manager := newManager(client, &now)
+
+	_, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.ErrorIs(t, err, certs.ErrNoCertificate)
+
+	// certificates are generated and CA is injected
+	require.NoError(t, manager.Ensure(context.Background()))
+
+	secret := getSecret(t, client)
+	require.Equal(t, corev1.SecretTypeTLS, secret.Type)
+
+	mutatingBundle, validatingBundle := getCABundles(t, client)
+	require.Equal(t, secret.Data[certs.SecretCACert], mutatingBundle)
+	require.Equal(t, secret.Data[certs.SecretCACert], validatingBundle)
+	verify(t, manager, mutatingBundle)
+
+	// valid certificates are kept
+	require.NoError(t, manager.Ensure(context.Background()))
+	require.Equal(t, secret.Data, getSecret(t, client).Data)
+
+	// another replica uses the same certificates
+	replica := newManager(client, &now)
+	require.NoError(t, replica.Ensure(context.Background()))
+	first, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	second, err := replica.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, first.Certificate, second.Certificate)
+
+	// serving certificate is renewed before it expires, CA is kept
+	now = now.Add(21 * 24 * time.Hour)
+	require.NoError(t, manager.Ensure(context.Background()))
+
+	renewed := getSecret(t, client)
+	require.NotEqual(t, secret.Data[corev1.TLSCertKey], renewed.Data[corev1.TLSCertKey])
+	require.Equal(t, secret.Data[certs.SecretCACert], renewed.Data[certs.SecretCACert])
+
+	renewedCert, err := manager.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.NotEqual(t, first.Certificate, renewedCert.Certificate)
+	verify(t, manager, mutatingBundle)
+}
+
+func TestManager_RenewCA(t *testing.T) {
+	client := newClient()
+	now := time.Now()
+	manager := newManager(client, &now)
+
+	require.NoError(t, manager.Ensure(context.Background()))
+	secret := getSecret(t, client)
+
+	// CA is renewed and the previous one is trusted until it expires
+	now = now.Add(9 * 365 * 24 * time.Hour)
+	require.NoError(t, manager.Ensure(context.Background()))
+
+	renewed := getSecret(t, client)
+	require.NotEqual(t, secret.Data[certs.SecretCACert], renewed.Data[certs.SecretCACert])
+	require.Equal(t, secret.Data[certs.SecretCACert], renewed.Data[certs.SecretPreviousCACert])
+
+	bundle, _ := getCABundles(t, client)
+	require.Contains(t, string(bundle), string(secret.Data[certs.SecretCACert]))
+	require.Contains(t, string(bundle), string(renewed.Data[certs.SecretCACert]))
+	verify(t, manager, bundle)
+
+	// the previous CA is removed from the bundle once it is expired
+	now = now.Add(2 * 365 * 24 * time.Hour)
+	require.NoError(t, manager.Ensure(context.Background()))
+
+	bundle, _ = getCABundles(t, client)
+	require.NotContains(t, string(bundle), string(secret.Data[certs.SecretCACert]))
+}
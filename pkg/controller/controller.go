@@ -2,43 +2,82 @@ package controller
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/surik/k8s-image-warden/pkg/audit"
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
 	"github.com/surik/k8s-image-warden/pkg/proto"
+	"github.com/surik/k8s-image-warden/pkg/registry"
 	"github.com/surik/k8s-image-warden/pkg/repo"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"gopkg.in/yaml.v3"
 )
 
 type Controller struct {
 	proto.ControllerServiceServer
 	grpcServer *grpc.Server
+	health     *health.Server
 	listener   net.Listener
+	serving    *atomic.Bool
+	doneCh     chan bool
 	engine     *engine.Engine
-	repo       *repo.Repo
+	repo       repo.Store
+	prober     *registry.Prober
+	signingKey ed25519.PrivateKey
+	// lastHead is the last head signed by the controller, the record it signs must stay in the chain.
+	lastHead *atomic.Pointer[audit.Head]
 }
 
-func NewController(endpoint string, repo *repo.Repo, engine *engine.Engine) *Controller {
+var (
+	ErrNoSigningKey = errors.New("audit signing key is not configured")
+	ErrNotServing   = errors.New("gRPC server is not serving")
+)
+
+// healthCheckInterval is how frequently the gRPC health status is updated.
+const healthCheckInterval = 5 * time.Second
+
+// auditHeadInterval is how frequently the end of the audit chain is signed, when there is a signing key.
+const auditHeadInterval = time.Minute
+
+// NewController creates the controller, signingKey is used to sign audit exports and heads of the audit chain and may be nil.
+func NewController(endpoint string, repo repo.Store, engine *engine.Engine, prober *registry.Prober, signingKey ed25519.PrivateKey) (*Controller, error) {
 	listener, err := net.Listen("tcp", endpoint)
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		return nil, err
 	}
 
 	log.Println("Listening on :" + listener.Addr().String())
 
 	ctrl := Controller{
 		grpcServer: grpc.NewServer(),
+		health:     health.NewServer(),
 		listener:   listener,
+		serving:    &atomic.Bool{},
+		doneCh:     make(chan bool),
 		engine:     engine,
 		repo:       repo,
+		prober:     prober,
+		signingKey: signingKey,
+		lastHead:   &atomic.Pointer[audit.Head]{},
 	}
 	proto.RegisterControllerServiceServer(ctrl.grpcServer, ctrl)
+	healthpb.RegisterHealthServer(ctrl.grpcServer, ctrl.health)
+
+	// not serving until the first check passes
+	ctrl.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	ctrl.health.SetServingStatus(proto.ControllerService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
 
-	return &ctrl
+	return &ctrl, nil
 }
 
 func ConvertReportToRepo(report *proto.ReportRequest) (*repo.Node, []repo.ImageFilesystemReport, []repo.ImageReport) {
@@ -92,19 +131,83 @@ func ConvertReportToRepo(report *proto.ReportRequest) (*repo.Node, []repo.ImageF
 }
 
 func (ctrl Controller) Validate(ctx context.Context, req *proto.ValidateRequest) (*proto.ValidateResponse, error) {
-	result, rule := ctrl.engine.Validate(ctx, req.Image)
-	return &proto.ValidateResponse{Valid: result, Rule: rule}, nil
+	validation := ctrl.engine.ValidateImage(ctx, req.Image)
+
+	ctrl.storeDecisions(validationDecision(req.Image, validation, repo.ModeGRPCValidate))
+
+	return &proto.ValidateResponse{Valid: validation.Allowed, Rule: validation.Rule, Reason: validation.Reason}, nil
+}
+
+func (ctrl Controller) ValidateImages(ctx context.Context, req *proto.ValidateImagesRequest) (*proto.ValidateImagesResponse, error) {
+	resp := &proto.ValidateImagesResponse{
+		Valid:   true,
+		Results: make([]*proto.ImageValidation, len(req.Images)),
+	}
+
+	decisions := make([]repo.Decision, len(req.Images))
+	for i, image := range req.Images {
+		validation := ctrl.engine.ValidateImage(ctx, image)
+		resp.Results[i] = &proto.ImageValidation{
+			Image:  image,
+			Valid:  validation.Allowed,
+			Rule:   validation.Rule,
+			Reason: validation.Reason,
+		}
+		resp.Valid = resp.Valid && validation.Allowed
+		decisions[i] = validationDecision(image, validation, repo.ModeGRPCValidate)
+	}
+
+	ctrl.storeDecisions(decisions...)
+
+	return resp, nil
 }
 
 func (ctrl Controller) Mutate(ctx context.Context, req *proto.MutateRequest) (*proto.MutateResponse, error) {
-	newImage, rules := ctrl.engine.Mutate(ctx, req.Image)
+	newImage, rules, err := ctrl.engine.Mutate(ctx, req.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.storeDecisions(mutationDecision(req.Image, newImage, rules, repo.ModeGRPCMutate))
+
 	return &proto.MutateResponse{Image: newImage, Rules: rules}, nil
 }
 
+func (ctrl Controller) Evaluate(ctx context.Context, req *proto.EvaluateRequest) (*proto.EvaluateResponse, error) {
+	evaluation := ctrl.engine.Evaluate(ctx, req.Image)
+
+	mutations := make([]*proto.MutationStep, len(evaluation.Mutations))
+	rules := make([]string, len(evaluation.Mutations))
+	for i, step := range evaluation.Mutations {
+		mutations[i] = &proto.MutationStep{Rule: step.Rule, Image: step.Image}
+		rules[i] = step.Rule
+	}
+
+	ctrl.storeDecisions(
+		mutationDecision(req.Image, evaluation.Image, rules, repo.ModeGRPCEvaluate),
+		validationDecision(evaluation.Image, engine.Validation{
+			Allowed: evaluation.Valid,
+			Rule:    evaluation.Rule,
+			Reason:  evaluation.Reason,
+			Shadow:  evaluation.Shadow,
+		}, repo.ModeGRPCEvaluate),
+	)
+
+	return &proto.EvaluateResponse{
+		Image:     evaluation.Image,
+		Mutations: mutations,
+		Valid:     evaluation.Valid,
+		Rule:      evaluation.Rule,
+		Reason:    evaluation.Reason,
+	}, nil
+}
+
 func (ctrl Controller) Report(ctx context.Context, report *proto.ReportRequest) (*proto.ReportResponse, error) {
 	node, fsUsage, images := ConvertReportToRepo(report)
 	err := ctrl.repo.StoreReport(node, fsUsage, images)
 
+	metrics.Reports.WithLabelValues(node.Nodename, metrics.Result(err)).Inc()
+
 	return &proto.ReportResponse{}, err
 }
 
@@ -183,7 +286,207 @@ func (ctrl Controller) GetReport(ctx context.Context, req *proto.GetReportReques
 	}, nil
 }
 
+func (ctrl Controller) GetRegistries(ctx context.Context, req *proto.GetRegistriesRequest) (*proto.GetRegistriesResponse, error) {
+	if ctrl.prober == nil {
+		return &proto.GetRegistriesResponse{}, nil
+	}
+
+	statuses := ctrl.prober.GetStatus()
+	registries := make([]*proto.RegistryStatus, len(statuses))
+	for i, status := range statuses {
+		registries[i] = &proto.RegistryStatus{
+			Registry: status.Registry,
+			Healthy:  status.Healthy,
+			Error:    status.Error,
+		}
+		if !status.LastChecked.IsZero() {
+			registries[i].LastChecked = status.LastChecked.UnixNano()
+		}
+	}
+
+	return &proto.GetRegistriesResponse{Registries: registries}, nil
+}
+
+func (ctrl Controller) GetDecisions(ctx context.Context, req *proto.GetDecisionsRequest) (*proto.GetDecisionsResponse, error) {
+	filter := repo.DecisionFilter{
+		Namespace:  req.Namespace,
+		Image:      req.Image,
+		Verdict:    req.Verdict,
+		Mode:       req.Mode,
+		Limit:      int(req.Limit),
+		ShadowDiff: req.ShadowDiff,
+	}
+	if req.Since > 0 {
+		filter.Since = time.Unix(0, req.Since)
+	}
+
+	decisions, err := ctrl.repo.GetDecisions(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &proto.GetDecisionsResponse{Decisions: make([]*proto.Decision, len(decisions))}
+	for i, decision := range decisions {
+		resp.Decisions[i] = &proto.Decision{
+			Timestamp:     decision.Timestamp.UnixNano(),
+			Namespace:     decision.Namespace,
+			Object:        decision.Object,
+			Owner:         decision.Owner,
+			Container:     decision.Container,
+			Image:         decision.Image,
+			Verdict:       decision.Verdict,
+			Rule:          decision.Rule,
+			Mode:          decision.Mode,
+			Reason:        decision.Reason,
+			ShadowVerdict: decision.ShadowVerdict,
+			ShadowRule:    decision.ShadowRule,
+		}
+	}
+
+	return resp, nil
+}
+
+func (ctrl Controller) VerifyAudit(ctx context.Context, req *proto.VerifyAuditRequest) (*proto.VerifyAuditResponse, error) {
+	var publicKey ed25519.PublicKey
+	if ctrl.signingKey != nil {
+		publicKey = ctrl.signingKey.Public().(ed25519.PublicKey)
+	}
+
+	records, err := ctrl.repo.VerifyAudit(publicKey)
+	if err == nil {
+		err = ctrl.verifyLastHead()
+	}
+	if errors.Is(err, audit.ErrBrokenChain) {
+		return &proto.VerifyAuditResponse{Valid: false, Records: int64(records), Error: err.Error()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.VerifyAuditResponse{Valid: true, Records: int64(records)}, nil
+}
+
+// verifyLastHead checks that the record signed by the last head of the controller is still in the chain,
+// so removing records from the end of the chain is detected as long as the controller runs.
+func (ctrl Controller) verifyLastHead() error {
+	head := ctrl.lastHead.Load()
+	if head == nil {
+		return nil
+	}
+
+	// the record was removed by retention
+	first, err := ctrl.repo.GetAuditRecords(0, 1)
+	if err != nil {
+		return err
+	}
+	if len(first) > 0 && first[0].ID > head.ID {
+		return nil
+	}
+
+	signed, err := ctrl.repo.GetAuditRecords(head.ID, 1)
+	if err != nil {
+		return err
+	}
+	if len(signed) == 0 || signed[0].ID != head.ID || signed[0].Hash != head.Hash {
+		return fmt.Errorf("%w: record %d signed by the last head is missing", audit.ErrBrokenChain, head.ID)
+	}
+
+	return nil
+}
+
+// signAuditHead signs the end of the audit chain.
+func (ctrl Controller) signAuditHead() {
+	head, err := ctrl.repo.SignAuditHead(ctrl.signingKey)
+	if err != nil {
+		log.Printf("error when signing audit head: %s", err)
+		return
+	}
+
+	if head != nil {
+		ctrl.lastHead.Store(head)
+	}
+}
+
+func (ctrl Controller) signAuditHeads() {
+	for {
+		select {
+		case <-ctrl.doneCh:
+			return
+		case <-time.After(auditHeadInterval):
+			ctrl.signAuditHead()
+		}
+	}
+}
+
+func (ctrl Controller) ExportAudit(ctx context.Context, req *proto.ExportAuditRequest) (*proto.ExportAuditResponse, error) {
+	if ctrl.signingKey == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	records, err := ctrl.repo.GetAuditRecords(req.FromId, int(req.Limit))
+	if err != nil {
+		return nil, err
+	}
+
+	batch := audit.Sign(records, ctrl.signingKey)
+
+	resp := &proto.ExportAuditResponse{
+		Records:   make([]*proto.AuditRecord, len(records)),
+		PublicKey: batch.PublicKey,
+		Signature: batch.Signature,
+	}
+	for i, record := range records {
+		resp.Records[i] = &proto.AuditRecord{
+			Id:        record.ID,
+			Timestamp: record.Timestamp,
+			Kind:      record.Kind,
+			Data:      record.Data,
+			PrevHash:  record.PrevHash,
+			Hash:      record.Hash,
+		}
+	}
+
+	return resp, nil
+}
+
+func validationDecision(image string, validation engine.Validation, mode string) repo.Decision {
+	decision := repo.Decision{Image: image, Verdict: validation.Verdict(), Rule: validation.Rule, Reason: validation.Reason, Mode: mode}
+	if validation.Shadow != nil {
+		decision.ShadowVerdict = validation.Shadow.Verdict()
+		decision.ShadowRule = validation.Shadow.Rule
+	}
+
+	return decision
+}
+
+func mutationDecision(image, newImage string, rules []string, mode string) repo.Decision {
+	verdict := repo.VerdictUnchanged
+	if newImage != image {
+		verdict = repo.VerdictMutated
+	}
+
+	return repo.Decision{Image: image, Verdict: verdict, Rule: strings.Join(rules, ","), Mode: mode}
+}
+
+func (ctrl Controller) storeDecisions(decisions ...repo.Decision) {
+	if ctrl.repo == nil {
+		return
+	}
+
+	if err := ctrl.repo.StoreDecisions(decisions); err != nil {
+		log.Printf("error when storing decisions: %s", err)
+	}
+}
+
 func (ctrl Controller) Run() error {
+	go ctrl.updateHealth()
+	if ctrl.signingKey != nil && ctrl.repo != nil {
+		go ctrl.signAuditHeads()
+	}
+
+	ctrl.serving.Store(true)
+	defer ctrl.serving.Store(false)
+
 	if err := ctrl.grpcServer.Serve(ctrl.listener); err != nil {
 		return err
 	}
@@ -191,5 +494,42 @@ func (ctrl Controller) Run() error {
 }
 
 func (ctrl Controller) Stop() {
+	close(ctrl.doneCh)
+	ctrl.health.Shutdown()
 	ctrl.grpcServer.Stop()
 }
+
+// Ready checks that the repo is writable and the gRPC server is serving. Rules are loaded
+// before the controller is created, so they need no check.
+func (ctrl Controller) Ready(_ context.Context) error {
+	if !ctrl.serving.Load() {
+		return ErrNotServing
+	}
+
+	if ctrl.repo != nil {
+		if err := ctrl.repo.CheckWritable(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateHealth reflects readiness in the gRPC health service.
+func (ctrl Controller) updateHealth() {
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		if err := ctrl.Ready(context.Background()); err != nil {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+
+		ctrl.health.SetServingStatus("", status)
+		ctrl.health.SetServingStatus(proto.ControllerService_ServiceDesc.ServiceName, status)
+
+		select {
+		case <-ctrl.doneCh:
+			return
+		case <-time.After(healthCheckInterval):
+		}
+	}
+}
@@ -2,16 +2,31 @@ package controller_test
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/audit"
 	"github.com/surik/k8s-image-warden/pkg/controller"
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	metricshelpers "github.com/surik/k8s-image-warden/pkg/metrics/testing"
 	"github.com/surik/k8s-image-warden/pkg/proto"
+	"github.com/surik/k8s-image-warden/pkg/registry"
+	repoapi "github.com/surik/k8s-image-warden/pkg/repo"
 	helpers "github.com/surik/k8s-image-warden/pkg/repo/testing"
 	"golang.org/x/exp/maps"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"gopkg.in/yaml.v3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func TestController(t *testing.T) {
@@ -37,8 +52,8 @@ func TestController(t *testing.T) {
 	require.NotNil(t, eng)
 	require.NoError(t, err)
 
-	controller := controller.NewController(":0", repo, eng)
-	require.NotNil(t, controller)
+	controller, err := controller.NewController(":0", repo, eng, nil, nil)
+	require.NoError(t, err)
 
 	responseRules, err := controller.GetRules(context.Background(), &proto.GetRulesRequest{})
 	require.NoError(t, err)
@@ -96,4 +111,187 @@ func TestController(t *testing.T) {
 
 	// report contains FS info
 	require.Equal(t, "/var/lib/docker", response.FilesystemUsage[helpers.Node3].ImageFilesystems[0].GetFsId().GetMountpoint())
+
+	// report is counted
+	require.Contains(t, metricshelpers.Scrape(t), `kiw_controller_reports_total{node="docker-desktop-3",result="success"} 1`)
+
+	// image is evaluated by the engine
+	evaluation, err := controller.Evaluate(context.Background(), &proto.EvaluateRequest{Image: "docker.io/nginx:latest"})
+	require.NoError(t, err)
+	require.True(t, evaluation.Valid)
+	require.Equal(t, "default rule", evaluation.Rule)
+	require.Equal(t, "docker.io/nginx:latest", evaluation.Image)
+	require.Empty(t, evaluation.Mutations)
+
+	// images are validated in batch
+	validation, err := controller.ValidateImages(context.Background(), &proto.ValidateImagesRequest{
+		Images: []string{"docker.io/nginx:latest", "docker.io/nginx:1.25.2"},
+	})
+	require.NoError(t, err)
+	require.False(t, validation.Valid)
+	require.Len(t, validation.Results, 2)
+	require.True(t, validation.Results[0].Valid)
+	require.Equal(t, "docker.io/nginx:latest", validation.Results[0].Image)
+	require.False(t, validation.Results[1].Valid)
+	require.Equal(t, "<No Rules>", validation.Results[1].Rule)
+
+	// gRPC validations and evaluations are recorded as decisions
+	decisions, err := controller.GetDecisions(context.Background(), &proto.GetDecisionsRequest{Mode: "grpc-validate"})
+	require.NoError(t, err)
+	require.Len(t, decisions.Decisions, 2)
+	require.Equal(t, "docker.io/nginx:1.25.2", decisions.Decisions[0].Image)
+	require.Equal(t, "denied", decisions.Decisions[0].Verdict)
+	require.Equal(t, "<No Rules>", decisions.Decisions[0].Rule)
+	require.Equal(t, "allowed", decisions.Decisions[1].Verdict)
+
+	decisions, err = controller.GetDecisions(context.Background(), &proto.GetDecisionsRequest{Mode: "grpc-evaluate", Verdict: "unchanged"})
+	require.NoError(t, err)
+	require.Len(t, decisions.Decisions, 1)
+	require.Equal(t, "docker.io/nginx:latest", decisions.Decisions[0].Image)
+
+	decisions, err = controller.GetDecisions(context.Background(), &proto.GetDecisionsRequest{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, decisions.Decisions, 1)
+
+	// decisions are chained in the audit trail
+	verification, err := controller.VerifyAudit(context.Background(), &proto.VerifyAuditRequest{})
+	require.NoError(t, err)
+	require.True(t, verification.Valid)
+	require.Greater(t, verification.Records, int64(0))
+
+	// export requires signing key
+	_, err = controller.ExportAudit(context.Background(), &proto.ExportAuditRequest{})
+	require.Error(t, err)
+
+	// controller without prober has no registries
+	registries, err := controller.GetRegistries(context.Background(), &proto.GetRegistriesRequest{})
+	require.NoError(t, err)
+	require.Empty(t, registries.Registries)
+}
+
+func TestController_GetRegistries(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	prober := registry.NewProber([]string{host}, time.Minute, srv.Client())
+	prober.Probe(context.Background())
+
+	controller, err := controller.NewController(":0", nil, nil, prober, nil)
+	require.NoError(t, err)
+
+	response, err := controller.GetRegistries(context.Background(), &proto.GetRegistriesRequest{})
+	require.NoError(t, err)
+	require.Len(t, response.Registries, 1)
+	require.Equal(t, host, response.Registries[0].Registry)
+	require.False(t, response.Registries[0].Healthy)
+	require.Greater(t, response.Registries[0].LastChecked, int64(0))
+}
+
+func TestController_ExportAudit(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	_, err := repo.StoreRulesChange("rules.yaml", []byte("rules: []"))
+	require.NoError(t, err)
+
+	err = repo.StoreDecisions([]repoapi.Decision{{Image: "docker.io/nginx:latest", Verdict: repoapi.VerdictDenied}})
+	require.NoError(t, err)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	controller, err := controller.NewController(":0", repo, nil, nil, privateKey)
+	require.NoError(t, err)
+
+	response, err := controller.ExportAudit(context.Background(), &proto.ExportAuditRequest{})
+	require.NoError(t, err)
+	require.Len(t, response.Records, 2)
+
+	batch := audit.Batch{Signature: response.Signature, PublicKey: response.PublicKey}
+	for _, record := range response.Records {
+		batch.Records = append(batch.Records, audit.Record{
+			ID:        record.Id,
+			Timestamp: record.Timestamp,
+			Kind:      record.Kind,
+			Data:      record.Data,
+			PrevHash:  record.PrevHash,
+			Hash:      record.Hash,
+		})
+	}
+	require.NoError(t, batch.Verify(publicKey))
+
+	// export of the chain tail is verifiable on its own
+	response, err = controller.ExportAudit(context.Background(), &proto.ExportAuditRequest{FromId: response.Records[1].Id})
+	require.NoError(t, err)
+	require.Len(t, response.Records, 1)
+	require.Equal(t, audit.KindDecision, response.Records[0].Kind)
+}
+
+func TestController_AuditHeads(t *testing.T) {
+	dsn := path.Join(t.TempDir(), "store.db")
+	repo := helpers.OpenTestRepo(t, dsn)
+
+	_, err := repo.StoreRulesChange("rules.yaml", []byte("rules: []"))
+	require.NoError(t, err)
+
+	err = repo.StoreDecisions([]repoapi.Decision{{Image: "docker.io/nginx:latest", Verdict: repoapi.VerdictDenied}})
+	require.NoError(t, err)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	controller, err := controller.NewController(":0", repo, nil, nil, privateKey)
+	require.NoError(t, err)
+
+	controller.SignAuditHead()
+
+	verification, err := controller.VerifyAudit(context.Background(), &proto.VerifyAuditRequest{})
+	require.NoError(t, err)
+	require.True(t, verification.Valid)
+	require.Equal(t, int64(3), verification.Records)
+
+	// the signed decision and its head are removed from the end of the chain
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Exec("DELETE FROM audit_records WHERE kind IN (?, ?)", audit.KindDecision, audit.KindHead).Error)
+
+	err = repo.StoreDecisions([]repoapi.Decision{{Image: "docker.io/nginx:1.25", Verdict: repoapi.VerdictAllowed}})
+	require.NoError(t, err)
+
+	verification, err = controller.VerifyAudit(context.Background(), &proto.VerifyAuditRequest{})
+	require.NoError(t, err)
+	require.False(t, verification.Valid)
+	require.Contains(t, verification.Error, "signed by the last head is missing")
+}
+
+func TestController_Health(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	eng, err := engine.NewEngine(repo, nil, nil)
+	require.NoError(t, err)
+
+	controller, err := controller.NewController("127.0.0.1:0", repo, eng, nil, nil)
+	require.NoError(t, err)
+
+	// not ready until gRPC server is serving
+	require.Error(t, controller.Ready(context.Background()))
+
+	go func() {
+		_ = controller.Run()
+	}()
+	defer controller.Stop()
+
+	conn, err := grpc.Dial(controller.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	require.Eventually(t, func() bool {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: proto.ControllerService_ServiceDesc.ServiceName})
+		return err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, controller.Ready(context.Background()))
 }
@@ -0,0 +1,9 @@
+package controller
+
+func (ctrl Controller) Addr() string {
+	return ctrl.listener.Addr().String()
+}
+
+func (ctrl Controller) SignAuditHead() {
+	ctrl.signAuditHead()
+}
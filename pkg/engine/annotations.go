@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+type annotationsKey struct{}
+
+// WithAnnotations makes annotations of the request available to validation rules
+// which are limited to annotated requests.
+func WithAnnotations(ctx context.Context, annotations map[string]string) context.Context {
+	if len(annotations) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, annotationsKey{}, annotations)
+}
+
+func annotationsFromContext(ctx context.Context) map[string]string {
+	annotations, _ := ctx.Value(annotationsKey{}).(map[string]string)
+	return annotations
+}
+
+// matchAnnotations checks that the request has all annotations of the rule, an empty value matches any value.
+func (r ValidationRule) matchAnnotations(ctx context.Context) bool {
+	if len(r.Annotations) == 0 {
+		return true
+	}
+
+	annotations := annotationsFromContext(ctx)
+	for key, value := range r.Annotations {
+		actual, ok := annotations[key]
+		if !ok || (value != "" && actual != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// annotationKeys returns sorted keys of annotations the rules depend on.
+func annotationKeys(rules []Rule) []string {
+	keys := make(map[string]struct{})
+	for _, rule := range rules {
+		for key := range rule.ValidationRule.Annotations {
+			keys[key] = struct{}{}
+		}
+	}
+
+	sorted := maps.Keys(keys)
+	slices.Sort(sorted)
+
+	return sorted
+}
+
+// annotationsCacheKey keeps apart verdicts made for requests with different values of the
+// annotations the rules depend on. Other annotations don't change the verdict. Keys and values
+// are quoted, so that separators within a value can't make different annotations look the same.
+func (e Engine) annotationsCacheKey(ctx context.Context) string {
+	if len(e.annotationKeys) == 0 {
+		return ""
+	}
+
+	annotations := annotationsFromContext(ctx)
+
+	var b strings.Builder
+	for _, key := range e.annotationKeys {
+		if value, ok := annotations[key]; ok {
+			b.WriteString("|" + strconv.Quote(key) + "=" + strconv.Quote(value))
+		}
+	}
+
+	return b.String()
+}
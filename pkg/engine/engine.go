@@ -2,26 +2,91 @@ package engine
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/docker/distribution/reference"
+	"github.com/surik/k8s-image-warden/pkg/cache"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
 	"github.com/surik/k8s-image-warden/pkg/repo"
 	"gopkg.in/yaml.v3"
 )
 
 type Engine struct {
 	rules     []Rule
-	repo      *repo.Repo
+	version   string
+	repo      repo.Store
 	inspector ImageInspector
+	prober    RegistryProber
+	verdicts  *cache.Cache[Validation]
+	keychain  Keychain
+	shadow    *Engine
+	// annotationKeys are annotations of the request the rules depend on
+	annotationKeys []string
+}
+
+// Validation is the verdict for an image and the rule which made it.
+type Validation struct {
+	Allowed bool
+	Rule    string
+	// Reason explains verdicts which were not made by the rule itself,
+	// e.g. by its policy when the registry was unavailable.
+	Reason string
+	// Warning is set when the image is allowed, but admission has to warn about it.
+	Warning bool
+	// Shadow is the verdict of the shadow rules, if they are set. It never affects the verdict.
+	Shadow *Validation
+}
+
+// RegistryProber reports registry health for Failover mutation rules.
+type RegistryProber interface {
+	IsHealthy(registry string) bool
+}
+
+// PodMutation describes changes of the pod spec required to run an image,
+// as opposed to the changes of the image reference itself.
+type PodMutation struct {
+	PullSecrets []string
+	PullPolicy  string
+	// PullSecretRules maps pull secrets to the first rule requiring them,
+	// PullPolicyRule is the rule which set the pull policy.
+	PullSecretRules map[string]string
+	PullPolicyRule  string
+}
+
+// MutationStep is the image reference after applying the mutation rule.
+type MutationStep struct {
+	Rule  string
+	Image string
+}
+
+// Evaluation is the result of the full mutation and validation pipeline.
+type Evaluation struct {
+	Image     string
+	Mutations []MutationStep
+	Valid     bool
+	Rule      string
+	Reason    string
+	Shadow    *Validation
 }
 
 var (
 	ErrBadImageReference = errors.New("bad image reference")
 )
 
-func NewEngine(repo *repo.Repo, inspector ImageInspector, rules []Rule) (*Engine, error) {
+const noRulesMatched = "<No Rules>"
+
+// rule types used as the metrics label
+const (
+	ruleTypeValidate = "validate"
+	ruleTypeMutate   = "mutate"
+)
+
+func NewEngine(repo repo.Store, inspector ImageInspector, rules []Rule) (*Engine, error) {
 	compiledRules := make([]Rule, len(rules))
 	for i, rule := range rules {
 		compiled, err := rule.compile()
@@ -31,14 +96,33 @@ func NewEngine(repo *repo.Repo, inspector ImageInspector, rules []Rule) (*Engine
 		compiledRules[i] = compiled
 	}
 
+	version, err := rulesVersion(rules)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Engine{
 		repo:      repo,
 		rules:     compiledRules,
+		version:   version,
 		inspector: inspector,
+
+		annotationKeys: annotationKeys(compiledRules),
 	}, nil
 }
 
-func NewEngineFromFile(repo *repo.Repo, inspector ImageInspector, file string) (*Engine, error) {
+// rulesVersion identifies the rule set, so cached verdicts of other rules are never used.
+func rulesVersion(rules []Rule) (string, error) {
+	data, err := yaml.Marshal(Rules{Rules: rules})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func NewEngineFromFile(repo repo.Store, inspector ImageInspector, file string) (*Engine, error) {
 	var rules Rules
 
 	yamlFile, err := os.ReadFile(file)
@@ -58,43 +142,260 @@ func (e Engine) GetRules() []Rule {
 	return e.rules
 }
 
+// GetFailoverRegistries returns all registries used by Failover rules, so they can be probed.
+func (e Engine) GetFailoverRegistries() []string {
+	var registries []string
+	known := make(map[string]bool)
+
+	for _, rule := range e.rules {
+		if rule.MutationRule.Type != MutationTypeFailover {
+			continue
+		}
+
+		for _, registry := range rule.MutationRule.Registries {
+			if !known[registry] {
+				known[registry] = true
+				registries = append(registries, registry)
+			}
+		}
+	}
+
+	return registries
+}
+
+func (e *Engine) SetRegistryProber(prober RegistryProber) {
+	e.prober = prober
+}
+
+// SetVerdictCache makes validation verdicts to be kept for ttl. Verdicts of rules depending on
+// reports, such as RollingTag, may become stale for ttl when new images are reported.
+func (e *Engine) SetVerdictCache(size int, ttl time.Duration) {
+	e.verdicts = cache.New[Validation]("verdicts", size, ttl)
+}
+
+// SetKeychain makes verdicts to be cached apart for credentials the inspector gets from the keychain,
+// as the registry may answer differently to requests with pull secrets of different namespaces.
+func (e *Engine) SetKeychain(keychain Keychain) {
+	e.keychain = keychain
+}
+
 func (e Engine) Validate(ctx context.Context, imageRef string) (bool, string) {
+	validation := e.ValidateImage(ctx, imageRef)
+	return validation.Allowed, validation.Rule
+}
+
+// ValidateImage returns the verdict for the image with the explanation of how it was made.
+func (e Engine) ValidateImage(ctx context.Context, imageRef string) Validation {
+	validation := e.cachedValidate(ctx, imageRef)
+
+	if validation.Rule != noRulesMatched {
+		metrics.RuleHits.WithLabelValues(validation.Rule, ruleTypeValidate).Inc()
+	}
+
+	if e.shadow != nil {
+		shadow := e.shadow.cachedValidate(ctx, imageRef)
+		validation.Shadow = &shadow
+
+		if shadow.Allowed != validation.Allowed {
+			metrics.ShadowDifferences.WithLabelValues(validation.Verdict(), shadow.Verdict(), shadow.Rule).Inc()
+		}
+	}
+
+	return validation
+}
+
+// SetShadow makes the shadow engine validate every image next to this one, so
+// verdicts of candidate rules can be compared before they are switched to.
+func (e *Engine) SetShadow(shadow *Engine) {
+	e.shadow = shadow
+}
+
+func (e Engine) cachedValidate(ctx context.Context, imageRef string) Validation {
+	if e.verdicts == nil {
+		validation, _ := e.validate(ctx, imageRef)
+		return validation
+	}
+
+	credentialsKey, err := credentialsCacheKey(ctx, e.keychain, imageRef)
+	if err != nil {
+		validation, _ := e.validate(ctx, imageRef)
+		return validation
+	}
+
+	// verdicts made without the registry are not cached, so the registry is asked again once it is back
+	key := e.version + "|" + imageRef + e.annotationsCacheKey(ctx) + credentialsKey
+	validation, _ := e.verdicts.Get(ctx, key, func(ctx context.Context) (Validation, error) {
+		return e.validate(ctx, imageRef)
+	})
+	if ctx.Err() != nil {
+		// the request is gone before the shared validation was done
+		validation, _ = e.validate(ctx, imageRef)
+	}
+
+	return validation
+}
+
+// Verdict is the verdict of the validation as it is recorded in decisions.
+func (v Validation) Verdict() string {
+	if v.Allowed {
+		return repo.VerdictAllowed
+	}
+	return repo.VerdictDenied
+}
+
+// validate returns ErrRegistryUnavailable along with the verdict, if the verdict was affected by the registry failure.
+func (e Engine) validate(ctx context.Context, imageRef string) (Validation, error) {
 	name, tag := ParseImageReference(imageRef)
 
+	var registryErr error
 	for _, rule := range e.rules {
-		if rule.ValidationRule.Match(ctx, e.repo, e.inspector, name, tag) {
-			return rule.ValidationRule.Allow, rule.Name
+		matched, err := rule.ValidationRule.Match(ctx, e.repo, e.inspector, name, tag)
+		if err != nil {
+			registryErr = err
+
+			if validation, ok := registryFailureValidation(rule, err); ok {
+				return validation, err
+			}
+			continue
 		}
+
+		if matched {
+			return Validation{Allowed: rule.ValidationRule.Allow, Rule: rule.Name}, registryErr
+		}
+	}
+
+	return Validation{Allowed: false, Rule: noRulesMatched}, registryErr
+}
+
+func registryFailureValidation(rule Rule, err error) (Validation, bool) {
+	switch rule.ValidationRule.OnRegistryFailure {
+	case RegistryFailureAllow:
+		return Validation{Allowed: true, Rule: rule.Name, Reason: fmt.Sprintf("allowed by registry failure policy: %s", err)}, true
+	case RegistryFailureDeny:
+		return Validation{Allowed: false, Rule: rule.Name, Reason: fmt.Sprintf("denied by registry failure policy: %s", err)}, true
+	case RegistryFailureWarn:
+		return Validation{
+			Allowed: true,
+			Rule:    rule.Name,
+			Reason:  fmt.Sprintf("allowed with warning by registry failure policy: %s", err),
+			Warning: true,
+		}, true
+	default:
+		return Validation{}, false
+	}
+}
+
+// Mutate returns the mutated image reference and names of the rules which mutated it.
+// Images which can't be mutated, e.g. untagged or pinned only by digest, are returned with an error.
+func (e Engine) Mutate(_ context.Context, imageRef string) (string, []string, error) {
+	image, steps, err := e.mutate(imageRef)
+	if err != nil {
+		return imageRef, nil, err
+	}
+
+	var rules []string
+	for _, step := range steps {
+		rules = append(rules, step.Rule)
+	}
+
+	return image, rules, nil
+}
+
+// Evaluate runs the mutation pipeline and validates the mutated image reference,
+// the same way as it happens when both admission webhooks are called.
+func (e Engine) Evaluate(ctx context.Context, imageRef string) Evaluation {
+	image, steps, err := e.mutate(imageRef)
+	if err != nil {
+		// an image that can't be mutated is validated as is
+		image = imageRef
 	}
 
-	return false, "<No Rules>"
+	validation := e.ValidateImage(ctx, image)
+
+	return Evaluation{
+		Image:     image,
+		Mutations: steps,
+		Valid:     validation.Allowed,
+		Rule:      validation.Rule,
+		Reason:    validation.Reason,
+		Shadow:    validation.Shadow,
+	}
 }
 
-func (e Engine) Mutate(_ context.Context, imageRef string) (string, []string) {
+func (e Engine) mutate(imageRef string) (string, []MutationStep, error) {
 	ref, err := reference.Parse(imageRef)
 	if err != nil {
-		return imageRef, []string{err.Error()}
+		return imageRef, nil, err
 	}
 
 	named, ok := ref.(reference.NamedTagged)
 	if !ok {
-		return imageRef, []string{fmt.Errorf("%w: could not cast to reference.NamedTagged", ErrBadImageReference).Error()}
+		return imageRef, nil, fmt.Errorf("%w: could not cast to reference.NamedTagged", ErrBadImageReference)
 	}
 
 	domain := reference.Domain(named)
-	var rules []string
+	var steps []MutationStep
+
+	// images pinned by both tag and digest keep the digest
+	var pin string
+	if digested, ok := ref.(reference.Digested); ok {
+		pin = "@" + digested.Digest().String()
+	}
 
 	for _, rule := range e.rules {
-		newDomain, mutated := rule.MutationRule.Mutate(domain)
+		newDomain, mutated := rule.MutationRule.Mutate(domain, e.prober)
 		if mutated {
+			metrics.RuleHits.WithLabelValues(rule.Name, ruleTypeMutate).Inc()
 			domain = newDomain
-			rules = append(rules, rule.Name)
+			steps = append(steps, MutationStep{
+				Rule:  rule.Name,
+				Image: domain + "/" + reference.Path(named) + ":" + named.Tag() + pin,
+			})
 		}
 	}
 
-	if len(rules) > 0 {
-		return domain + "/" + reference.Path(named) + ":" + named.Tag(), rules
+	if len(steps) > 0 {
+		return steps[len(steps)-1].Image, steps, nil
+	}
+
+	return imageRef, steps, nil
+}
+
+func (e Engine) MutatePod(_ context.Context, imageRef string) (PodMutation, []string) {
+	var mutation PodMutation
+	var rules []string
+
+	ref, err := reference.Parse(imageRef)
+	if err != nil {
+		return mutation, rules
+	}
+
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return mutation, rules
+	}
+
+	domain := reference.Domain(named)
+	_, tag := ParseImageReference(imageRef)
+
+	for _, rule := range e.rules {
+		if rule.MutationRule.MutatePod(domain, tag, &mutation) {
+			metrics.RuleHits.WithLabelValues(rule.Name, ruleTypeMutate).Inc()
+			rules = append(rules, rule.Name)
+
+			switch rule.MutationRule.Type {
+			case MutationTypePullSecret:
+				if mutation.PullSecretRules == nil {
+					mutation.PullSecretRules = make(map[string]string)
+				}
+				if _, ok := mutation.PullSecretRules[rule.MutationRule.PullSecret]; !ok {
+					mutation.PullSecretRules[rule.MutationRule.PullSecret] = rule.Name
+				}
+			case MutationTypePullPolicy:
+				mutation.PullPolicyRule = rule.Name
+			}
+		}
 	}
 
-	return imageRef, rules
+	return mutation, rules
 }
@@ -2,6 +2,9 @@ package engine_test
 
 import (
 	"context"
+	"errors"
+	"net"
+	"os"
 	"path"
 	"testing"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	metricshelpers "github.com/surik/k8s-image-warden/pkg/metrics/testing"
 	helpers "github.com/surik/k8s-image-warden/pkg/repo/testing"
 )
 
@@ -18,11 +22,11 @@ func newFakeInspector() *fakeInspector {
 	return &fakeInspector{}
 }
 
-func (i *fakeInspector) GetDigest(_ context.Context, name string) (string, error) {
+func (i *fakeInspector) GetDigests(_ context.Context, name string) (engine.Digests, error) {
 	if name == "docker://k8s-image-warden-controller:latest" {
-		return helpers.Digest2, nil
+		return engine.Digests{Manifests: []string{helpers.Digest2}}, nil
 	}
-	return "", nil
+	return engine.Digests{}, nil
 }
 
 func TestEngine_Validate(t *testing.T) {
@@ -106,6 +110,167 @@ func TestEngine_Mutate(t *testing.T) {
 	mutate(t, ruleEngine, "ghc.io/org/app:latest", "ghc.io/org/app:latest", nil)
 	mutate(t, ruleEngine, "docker.com/nginx:latest", "docker.io/nginx:latest", []string{rules[1].Name})
 	mutate(t, ruleEngine, "docker.net/nginx:latest", "docker.io/nginx:latest", []string{rules[1].Name})
+
+	mutate(t, ruleEngine, "docker.com/nginx:latest@sha256:9f76a008888da28c6490bedf7bdaa919bac9b2be827afd58d6eb1b916eaa5911",
+		"docker.io/nginx:latest@sha256:9f76a008888da28c6490bedf7bdaa919bac9b2be827afd58d6eb1b916eaa5911", []string{rules[1].Name})
+
+	// images pinned only by digest are not mutated
+	image := "docker.com/nginx@sha256:9f76a008888da28c6490bedf7bdaa919bac9b2be827afd58d6eb1b916eaa5911"
+	reference, mutatedBy, err := ruleEngine.Mutate(context.Background(), image)
+	require.ErrorIs(t, err, engine.ErrBadImageReference)
+	require.Equal(t, image, reference)
+	require.Empty(t, mutatedBy)
+}
+
+func TestEngine_MutatePod(t *testing.T) {
+	rules := []engine.Rule{
+		{
+			Name: "mirror needs credentials",
+			MutationRule: engine.MutationRule{
+				Type:       engine.MutationTypePullSecret,
+				Registry:   `mirror\.mycompany\.com`,
+				PullSecret: "mirror-credentials",
+			},
+		},
+		{
+			Name: "always pull rolling tags",
+			MutationRule: engine.MutationRule{
+				Type:     engine.MutationTypePullPolicy,
+				ImageTag: "^(latest|main)$",
+			},
+		},
+	}
+
+	ruleEngine, err := engine.NewEngine(nil, nil, rules)
+	require.NoError(t, err)
+
+	mutation, applied := ruleEngine.MutatePod(context.Background(), "mirror.mycompany.com/nginx:latest")
+	require.Equal(t, []string{"mirror-credentials"}, mutation.PullSecrets)
+	require.Equal(t, engine.DefaultPullPolicy, mutation.PullPolicy)
+	require.Equal(t, []string{rules[0].Name, rules[1].Name}, applied)
+	require.Equal(t, map[string]string{"mirror-credentials": rules[0].Name}, mutation.PullSecretRules)
+	require.Equal(t, rules[1].Name, mutation.PullPolicyRule)
+
+	mutation, applied = ruleEngine.MutatePod(context.Background(), "mirror.mycompany.com/nginx:1.25.2")
+	require.Equal(t, []string{"mirror-credentials"}, mutation.PullSecrets)
+	require.Empty(t, mutation.PullPolicy)
+	require.Equal(t, []string{rules[0].Name}, applied)
+
+	mutation, applied = ruleEngine.MutatePod(context.Background(), "docker.io/nginx:main")
+	require.Empty(t, mutation.PullSecrets)
+	require.Equal(t, engine.DefaultPullPolicy, mutation.PullPolicy)
+	require.Equal(t, []string{rules[1].Name}, applied)
+
+	_, err = engine.NewEngine(nil, nil, []engine.Rule{
+		{
+			Name: "unknown pull policy",
+			MutationRule: engine.MutationRule{
+				Type:       engine.MutationTypePullPolicy,
+				PullPolicy: "Sometimes",
+			},
+		},
+	})
+	require.ErrorIs(t, err, engine.ErrWrongPullPolicy)
+}
+
+type fakeProber map[string]bool
+
+func (p fakeProber) IsHealthy(registry string) bool {
+	return p[registry]
+}
+
+func TestEngine_MutateFailover(t *testing.T) {
+	rules := []engine.Rule{
+		{
+			Name: "mirror is default",
+			MutationRule: engine.MutationRule{
+				Type:     engine.MutationTypeDefaultRegistry,
+				Registry: "mirror.mycompany.com",
+			},
+		},
+		{
+			Name: "failover to upstream",
+			MutationRule: engine.MutationRule{
+				Type:       engine.MutationTypeFailover,
+				Registries: []string{"mirror.mycompany.com", "docker.io"},
+			},
+		},
+	}
+
+	ruleEngine, err := engine.NewEngine(nil, nil, rules)
+	require.NoError(t, err)
+
+	prober := fakeProber{"mirror.mycompany.com": true, "docker.io": true}
+	ruleEngine.SetRegistryProber(prober)
+	require.Equal(t, []string{"mirror.mycompany.com", "docker.io"}, ruleEngine.GetFailoverRegistries())
+
+	mutate(t, ruleEngine, "nginx:latest", "mirror.mycompany.com/nginx:latest", []string{rules[0].Name})
+	mutate(t, ruleEngine, "ghcr.io/nginx:latest", "ghcr.io/nginx:latest", nil)
+
+	prober["mirror.mycompany.com"] = false
+	mutate(t, ruleEngine, "nginx:latest", "docker.io/nginx:latest", []string{rules[0].Name, rules[1].Name})
+	mutate(t, ruleEngine, "mirror.mycompany.com/nginx:latest", "docker.io/nginx:latest", []string{rules[1].Name})
+
+	// nothing is healthy, keep the reference as is
+	prober["docker.io"] = false
+	mutate(t, ruleEngine, "mirror.mycompany.com/nginx:latest", "mirror.mycompany.com/nginx:latest", nil)
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	rules := []engine.Rule{
+		{
+			Name: "docker.io is default",
+			MutationRule: engine.MutationRule{
+				Type:     engine.MutationTypeDefaultRegistry,
+				Registry: "docker.io",
+			},
+		},
+		{
+			Name: "use our mirror",
+			MutationRule: engine.MutationRule{
+				Type:        engine.MutationTypeRewriteRegistry,
+				Registry:    `docker\.io`,
+				NewRegistry: "mirror.mycompany.com",
+			},
+		},
+		{
+			Name: "No Latest",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeLatest,
+				Allow: false,
+			},
+		},
+		{
+			Name: "only mirrored nginx",
+			ValidationRule: engine.ValidationRule{
+				Type:      engine.ValidateTypeSemVer,
+				ImageName: `^mirror\.mycompany\.com/nginx$`,
+				ImageTag:  ">= 1.0.0",
+				Allow:     true,
+			},
+		},
+	}
+
+	ruleEngine, err := engine.NewEngine(nil, nil, rules)
+	require.NoError(t, err)
+
+	evaluation := ruleEngine.Evaluate(context.Background(), "nginx:1.25.2")
+	require.Equal(t, "mirror.mycompany.com/nginx:1.25.2", evaluation.Image)
+	require.Equal(t, []engine.MutationStep{
+		{Rule: rules[0].Name, Image: "docker.io/nginx:1.25.2"},
+		{Rule: rules[1].Name, Image: "mirror.mycompany.com/nginx:1.25.2"},
+	}, evaluation.Mutations)
+	require.True(t, evaluation.Valid)
+	require.Equal(t, rules[3].Name, evaluation.Rule)
+
+	// the unmutated reference would not be allowed
+	validate(t, ruleEngine, "nginx:1.25.2", false, "<No Rules>")
+
+	evaluation = ruleEngine.Evaluate(context.Background(), "ghcr.io/nginx:latest")
+	require.Equal(t, "ghcr.io/nginx:latest", evaluation.Image)
+	require.Empty(t, evaluation.Mutations)
+	require.False(t, evaluation.Valid)
+	require.Equal(t, rules[2].Name, evaluation.Rule)
 }
 
 func TestEngine_ParseYaml(t *testing.T) {
@@ -133,6 +298,35 @@ func TestEngine_ParseYaml(t *testing.T) {
 	require.GreaterOrEqual(t, rules[3].ValidationRule.RollingTagAfter, after)
 }
 
+func TestEngine_ParseYamlNewRegistry(t *testing.T) {
+	file := path.Join(t.TempDir(), "rules.yaml")
+	err := os.WriteFile(file, []byte(`rules:
+  - name: change quay.io to docker.io
+    mutate:
+      type: RewriteRegistry
+      registry: quay.io
+      newRegistry: docker.io
+  - name: earlier spelling
+    mutate:
+      type: RewriteRegistry
+      registry: ghcr.io
+      newRegisty: docker.io
+`), 0o600)
+	require.NoError(t, err)
+
+	e, err := engine.NewEngineFromFile(nil, nil, file)
+	require.NoError(t, err)
+
+	rules := e.GetRules()
+	require.Len(t, rules, 2)
+	require.Equal(t, "docker.io", rules[0].MutationRule.NewRegistry)
+	require.Equal(t, "docker.io", rules[1].MutationRule.NewRegistry)
+
+	image, _, err := e.Mutate(context.Background(), "quay.io/nginx:1.25")
+	require.NoError(t, err)
+	require.Equal(t, "docker.io/nginx:1.25", image)
+}
+
 func TestEngine_ValidateRollingTags(t *testing.T) {
 	repo := helpers.NewTestRepo(t)
 
@@ -184,6 +378,197 @@ func TestEngine_ValidateRollingTags(t *testing.T) {
 	})
 }
 
+type staticInspector engine.Digests
+
+func (i staticInspector) GetDigests(context.Context, string) (engine.Digests, error) {
+	return engine.Digests(i), nil
+}
+
+func TestEngine_ValidateRollingTagsMultiArch(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	err := helpers.PrepareRollingTags(repo)
+	require.NoError(t, err)
+
+	rules := []engine.Rule{
+		{
+			Name: "No Rolling tags",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeRollingTag,
+				Allow: false,
+			},
+		},
+		{
+			Name: "Allow Latest",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeLatest,
+				Allow: true,
+			},
+		},
+	}
+
+	// the node recorded helpers.Digest1 for k8s-image-warden-controller:latest
+	tests := []struct {
+		name    string
+		digests engine.Digests
+		allowed bool
+		rule    string
+	}{
+		{"Node recorded the index digest", engine.Digests{Index: helpers.Digest1, Manifests: []string{helpers.Digest2, helpers.Digest3}}, true, rules[1].Name},
+		{"Node recorded the platform digest", engine.Digests{Index: helpers.Digest3, Manifests: []string{helpers.Digest2, helpers.Digest1}}, true, rules[1].Name},
+		{"Single manifest", engine.Digests{Manifests: []string{helpers.Digest1}}, true, rules[1].Name},
+		{"Tag was moved", engine.Digests{Index: helpers.Digest3, Manifests: []string{helpers.Digest2}}, false, rules[0].Name},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ruleEngine, err := engine.NewEngine(repo, staticInspector(tt.digests), rules)
+			require.NoError(t, err)
+			validate(t, ruleEngine, "k8s-image-warden-controller:latest", tt.allowed, tt.rule)
+		})
+	}
+}
+
+type countingInspector struct {
+	fakeInspector
+	calls int
+}
+
+func (i *countingInspector) GetDigests(ctx context.Context, name string) (engine.Digests, error) {
+	i.calls++
+	return i.fakeInspector.GetDigests(ctx, name)
+}
+
+func TestEngine_Cache(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	err := helpers.PrepareRollingTags(repo)
+	require.NoError(t, err)
+
+	rules := []engine.Rule{
+		{
+			Name: "No Rolling tags",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeRollingTag,
+				Allow: false,
+			},
+		},
+	}
+
+	t.Run("Inspector is cached", func(t *testing.T) {
+		inspector := &countingInspector{}
+		ruleEngine, err := engine.NewEngine(repo, engine.NewCachedImageInspector(inspector, nil, 10, time.Minute), rules)
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			validate(t, ruleEngine, "k8s-image-warden-controller:latest", false, rules[0].Name)
+		}
+		require.Equal(t, 1, inspector.calls)
+	})
+
+	t.Run("Verdicts are cached", func(t *testing.T) {
+		inspector := &countingInspector{}
+		ruleEngine, err := engine.NewEngine(repo, inspector, rules)
+		require.NoError(t, err)
+		ruleEngine.SetVerdictCache(10, time.Minute)
+
+		for i := 0; i < 3; i++ {
+			validate(t, ruleEngine, "k8s-image-warden-controller:latest", false, rules[0].Name)
+		}
+		require.Equal(t, 1, inspector.calls)
+	})
+}
+
+// errUnreachable is a transport error, as the inspector returns it for a registry which is down.
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+type failingInspector struct {
+	calls int
+	err   error
+}
+
+func (i *failingInspector) GetDigests(context.Context, string) (engine.Digests, error) {
+	i.calls++
+	if i.err != nil {
+		return engine.Digests{}, i.err
+	}
+	return engine.Digests{}, errUnreachable
+}
+
+func TestEngine_RegistryFailure(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	err := helpers.PrepareRollingTags(repo)
+	require.NoError(t, err)
+
+	newRules := func(policy engine.RegistryFailurePolicy) []engine.Rule {
+		return []engine.Rule{
+			{
+				Name: "No Rolling tags",
+				ValidationRule: engine.ValidationRule{
+					Type:              engine.ValidateTypeRollingTag,
+					Allow:             false,
+					OnRegistryFailure: policy,
+				},
+			},
+			{
+				Name: "Allow Latest",
+				ValidationRule: engine.ValidationRule{
+					Type:  engine.ValidateTypeLatest,
+					Allow: true,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		policy  engine.RegistryFailurePolicy
+		allowed bool
+		rule    string
+		reason  string
+		warning bool
+	}{
+		{"", true, "Allow Latest", "", false},
+		{engine.RegistryFailureAllow, true, "No Rolling tags", "allowed by registry failure policy", false},
+		{engine.RegistryFailureDeny, false, "No Rolling tags", "denied by registry failure policy", false},
+		{engine.RegistryFailureWarn, true, "No Rolling tags", "allowed with warning by registry failure policy", true},
+	}
+
+	for _, tt := range tests {
+		t.Run("Policy "+string(tt.policy), func(t *testing.T) {
+			inspector := &failingInspector{}
+			ruleEngine, err := engine.NewEngine(repo, inspector, newRules(tt.policy))
+			require.NoError(t, err)
+			ruleEngine.SetVerdictCache(10, time.Minute)
+
+			for i := 0; i < 2; i++ {
+				validation := ruleEngine.ValidateImage(context.Background(), "k8s-image-warden-controller:latest")
+				require.Equal(t, tt.allowed, validation.Allowed)
+				require.Equal(t, tt.rule, validation.Rule)
+				require.Contains(t, validation.Reason, tt.reason)
+				require.Equal(t, tt.warning, validation.Warning)
+			}
+
+			// verdicts made without the registry are not cached
+			require.Equal(t, 2, inspector.calls)
+		})
+	}
+
+	t.Run("Registry answered with an error", func(t *testing.T) {
+		inspector := &failingInspector{err: errors.New("reading manifest latest in k8s-image-warden-controller: manifest unknown")}
+		ruleEngine, err := engine.NewEngine(repo, inspector, newRules(engine.RegistryFailureDeny))
+		require.NoError(t, err)
+
+		// the policy applies only to unavailable registries
+		validate(t, ruleEngine, "k8s-image-warden-controller:latest", true, "Allow Latest")
+	})
+
+	t.Run("Wrong policy", func(t *testing.T) {
+		_, err := engine.NewEngine(repo, newFakeInspector(), newRules("Ignore"))
+		require.ErrorIs(t, err, engine.ErrWrongRegistryFailurePolicy)
+	})
+}
+
 func validate(t *testing.T, ruleEngine *engine.Engine, image string, expectedResult bool, expectedRule string) {
 	t.Helper()
 
@@ -203,7 +588,8 @@ func validate(t *testing.T, ruleEngine *engine.Engine, image string, expectedRes
 func mutate(t *testing.T, ruleEngine *engine.Engine, image string, expectedReference string, expectedRules []string) {
 	t.Helper()
 
-	reference, rules := ruleEngine.Mutate(context.Background(), image)
+	reference, rules, err := ruleEngine.Mutate(context.Background(), image)
+	require.NoError(t, err)
 
 	if !assert.Equal(t, expectedReference, reference) {
 		t.FailNow()
@@ -215,3 +601,107 @@ func mutate(t *testing.T, ruleEngine *engine.Engine, image string, expectedRefer
 
 	t.FailNow()
 }
+
+func TestEngine_Shadow(t *testing.T) {
+	rules := []engine.Rule{
+		{
+			Name: "nginx is newer than 1.0.0",
+			ValidationRule: engine.ValidationRule{
+				Type:      engine.ValidateTypeSemVer,
+				ImageName: `docker\.io/nginx`,
+				ImageTag:  ">= 1.0.0",
+				Allow:     true,
+			},
+		},
+	}
+
+	shadowRules := []engine.Rule{
+		{
+			Name: "nginx is newer than 1.25.0",
+			ValidationRule: engine.ValidationRule{
+				Type:      engine.ValidateTypeSemVer,
+				ImageName: `docker\.io/nginx`,
+				ImageTag:  ">= 1.25.0",
+				Allow:     true,
+			},
+		},
+	}
+
+	ruleEngine, err := engine.NewEngine(nil, nil, rules)
+	require.NoError(t, err)
+
+	validation := ruleEngine.ValidateImage(context.Background(), "docker.io/nginx:1.9.1")
+	require.Nil(t, validation.Shadow)
+
+	shadow, err := engine.NewEngine(nil, nil, shadowRules)
+	require.NoError(t, err)
+	ruleEngine.SetShadow(shadow)
+
+	// the shadow verdict doesn't affect the verdict
+	validate(t, ruleEngine, "docker.io/nginx:1.9.1", true, rules[0].Name)
+
+	validation = ruleEngine.ValidateImage(context.Background(), "docker.io/nginx:1.9.1")
+	require.True(t, validation.Allowed)
+	require.NotNil(t, validation.Shadow)
+	require.False(t, validation.Shadow.Allowed)
+	require.Equal(t, "<No Rules>", validation.Shadow.Rule)
+
+	validation = ruleEngine.ValidateImage(context.Background(), "docker.io/nginx:1.25.2")
+	require.True(t, validation.Allowed)
+	require.True(t, validation.Shadow.Allowed)
+	require.Equal(t, shadowRules[0].Name, validation.Shadow.Rule)
+
+	evaluation := ruleEngine.Evaluate(context.Background(), "docker.io/nginx:1.9.1")
+	require.True(t, evaluation.Valid)
+	require.False(t, evaluation.Shadow.Allowed)
+
+	body := metricshelpers.Scrape(t)
+	require.Contains(t, body, `kiw_shadow_differences_total{shadow_rule="<No Rules>",shadow_verdict="denied",verdict="allowed"} 3`)
+	require.NotContains(t, body, `shadow_rule="nginx is newer than 1.25.0"`)
+}
+
+func TestEngine_Annotations(t *testing.T) {
+	rules := []engine.Rule{
+		{
+			Name: "Latest for experiments",
+			ValidationRule: engine.ValidationRule{
+				Type:        engine.ValidateTypeLatest,
+				Allow:       true,
+				Annotations: map[string]string{"kiw.io/purpose": "experiment", "kiw.io/ticket": ""},
+			},
+		},
+		{
+			Name: "No Latest",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeLatest,
+				Allow: false,
+			},
+		},
+	}
+
+	ruleEngine, err := engine.NewEngine(nil, nil, rules)
+	require.NoError(t, err)
+	ruleEngine.SetVerdictCache(10, time.Minute)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		allowed     bool
+		rule        string
+	}{
+		{"No annotations", nil, false, rules[1].Name},
+		{"Any ticket", map[string]string{"kiw.io/purpose": "experiment", "kiw.io/ticket": "INC-1"}, true, rules[0].Name},
+		{"Ambiguous value", map[string]string{"kiw.io/purpose": "experiment|kiw.io/ticket=INC-1"}, false, rules[1].Name},
+		{"Other value", map[string]string{"kiw.io/purpose": "production", "kiw.io/ticket": "INC-1"}, false, rules[1].Name},
+		{"Missing annotation", map[string]string{"kiw.io/purpose": "experiment"}, false, rules[1].Name},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := engine.WithAnnotations(context.Background(), tt.annotations)
+			validation := ruleEngine.ValidateImage(ctx, "docker.io/nginx:latest")
+			require.Equal(t, tt.allowed, validation.Allowed)
+			require.Equal(t, tt.rule, validation.Rule)
+		})
+	}
+}
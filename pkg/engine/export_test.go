@@ -0,0 +1,11 @@
+package engine
+
+import "github.com/containers/image/v5/types"
+
+func DigestsFromManifest(raw []byte, mimeType string) (Digests, error) {
+	return digestsFromManifest(raw, mimeType)
+}
+
+func (i *imageInspector) SystemContext() *types.SystemContext {
+	return i.sys
+}
@@ -2,51 +2,224 @@ package engine
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
 	"time"
 
+	dockerreference "github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/reference"
+	"github.com/surik/k8s-image-warden/pkg/cache"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
+	"golang.org/x/exp/slices"
 )
 
 type ImageInspector interface {
-	GetDigest(context.Context, string) (string, error)
+	GetDigests(context.Context, string) (Digests, error)
+}
+
+// Digests of an image reference. For a manifest list or an OCI index, Index is its digest and
+// Manifests are digests of per-platform manifests. Otherwise Manifests has the only manifest digest.
+type Digests struct {
+	Index     string
+	Manifests []string
+}
+
+// Contains reports whether the digest refers to the image, either to its index or to one of its manifests.
+// Container runtimes record the index digest of multi-arch images or the platform one, depending on the runtime.
+func (d Digests) Contains(digest string) bool {
+	return (d.Index != "" && d.Index == digest) || slices.Contains(d.Manifests, digest)
+}
+
+// CircuitBreaker stops calls to failing registries.
+type CircuitBreaker interface {
+	Allow(registry string) error
+	Report(registry string, err error)
+}
+
+// Keychain gives credentials of the registry for the request in the context, nil when there are none.
+type Keychain interface {
+	Credentials(ctx context.Context, registry string) (*types.DockerAuthConfig, error)
 }
 
 type imageInspector struct {
-	sys *types.SystemContext
+	sys      *types.SystemContext
+	timeout  time.Duration
+	keychain Keychain
 }
 
-func NewImageInspector() *imageInspector {
+// NewImageInspector returns inspector which gives up on registry requests after the timeout.
+func NewImageInspector(timeout time.Duration) *imageInspector {
 	return &imageInspector{
-		sys: &types.SystemContext{},
+		sys:     &types.SystemContext{},
+		timeout: timeout,
 	}
 }
 
-func (i *imageInspector) GetDigest(ctx context.Context, name string) (string, error) {
-	ref, err := alltransports.ParseImageName(name)
+// SetAuthFile makes the inspector authenticate with credentials of a docker config.json.
+func (i *imageInspector) SetAuthFile(file string) {
+	i.sys.AuthFilePath = file
+}
+
+// SetKeychain makes the inspector prefer credentials of the keychain over the auth file.
+func (i *imageInspector) SetKeychain(keychain Keychain) {
+	i.keychain = keychain
+}
+
+type cachedImageInspector struct {
+	inspector ImageInspector
+	keychain  Keychain
+	digests   *cache.Cache[Digests]
+}
+
+// NewCachedImageInspector returns inspector which keeps digests of references for ttl,
+// so the registry is not asked for every container of a scaled up workload. Digests are
+// kept apart for credentials of the keychain the inspector uses, if it is given.
+func NewCachedImageInspector(inspector ImageInspector, keychain Keychain, size int, ttl time.Duration) ImageInspector {
+	return &cachedImageInspector{
+		inspector: inspector,
+		keychain:  keychain,
+		digests:   cache.New[Digests]("inspector", size, ttl),
+	}
+}
+
+func (i *cachedImageInspector) GetDigests(ctx context.Context, name string) (Digests, error) {
+	key, err := credentialsCacheKey(ctx, i.keychain, name)
 	if err != nil {
+		return i.inspector.GetDigests(ctx, name)
+	}
+
+	return i.digests.Get(ctx, name+key, func(ctx context.Context) (Digests, error) {
+		return i.inspector.GetDigests(ctx, name)
+	})
+}
+
+// credentialsCacheKey keeps apart results of registry lookups made with different credentials, so an image
+// inspected with pull secrets of one namespace is never served to another one. It fails along with the keychain,
+// as the credentials of the lookup are unknown then and its result must not be cached.
+func credentialsCacheKey(ctx context.Context, keychain Keychain, name string) (string, error) {
+	if keychain == nil {
+		return "", nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(name, "docker://"))
+	if err != nil {
+		return "", nil
+	}
+
+	auth, err := keychain.Credentials(ctx, reference.Domain(named))
+	if err != nil || auth == nil {
 		return "", err
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	sum := sha256.Sum256([]byte(auth.Username + "\x00" + auth.Password + "\x00" + auth.IdentityToken))
+	return "|" + hex.EncodeToString(sum[:]), nil
+}
+
+type circuitBreakerImageInspector struct {
+	inspector ImageInspector
+	breaker   CircuitBreaker
+}
+
+// NewCircuitBreakerImageInspector returns inspector which doesn't call registries with open circuit.
+func NewCircuitBreakerImageInspector(inspector ImageInspector, breaker CircuitBreaker) ImageInspector {
+	return &circuitBreakerImageInspector{
+		inspector: inspector,
+		breaker:   breaker,
+	}
+}
+
+func (i *circuitBreakerImageInspector) GetDigests(ctx context.Context, name string) (Digests, error) {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(name, "docker://"))
+	if err != nil {
+		return i.inspector.GetDigests(ctx, name)
+	}
+
+	registry := reference.Domain(named)
+	if err := i.breaker.Allow(registry); err != nil {
+		return Digests{}, err
+	}
+
+	digests, err := i.inspector.GetDigests(ctx, name)
+	i.breaker.Report(registry, err)
+
+	return digests, err
+}
+
+func (i *imageInspector) GetDigests(ctx context.Context, name string) (digests Digests, err error) {
+	defer func(start time.Time) {
+		metrics.InspectorDuration.WithLabelValues(metrics.Result(err)).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	ref, err := alltransports.ParseImageName(name)
+	if err != nil {
+		return Digests{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, i.timeout)
 	defer cancel()
 
-	src, err := ref.NewImageSource(ctx, i.sys)
+	src, err := ref.NewImageSource(ctx, i.systemContext(ctx, ref))
 	if err != nil {
-		return "", err
+		return Digests{}, err
 	}
 	defer src.Close()
 
-	raw, _, err := src.GetManifest(ctx, nil)
+	raw, mimeType, err := src.GetManifest(ctx, nil)
 	if err != nil {
-		return "", err
+		return Digests{}, err
+	}
+
+	return digestsFromManifest(raw, mimeType)
+}
+
+// digestsFromManifest returns digests of the manifest and, for a manifest list or an OCI index, of its instances.
+func digestsFromManifest(raw []byte, mimeType string) (Digests, error) {
+	manifestDigest, err := manifest.Digest(raw)
+	if err != nil {
+		return Digests{}, err
+	}
+
+	mimeType = manifest.NormalizedMIMEType(mimeType)
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return Digests{Manifests: []string{manifestDigest.String()}}, nil
 	}
 
-	digest, err := manifest.Digest(raw)
+	list, err := manifest.ListFromBlob(raw, mimeType)
 	if err != nil {
-		return "", err
+		return Digests{}, err
+	}
+
+	digests := Digests{Index: manifestDigest.String()}
+	for _, instance := range list.Instances() {
+		digests.Manifests = append(digests.Manifests, instance.String())
 	}
 
-	return digest.String(), nil
+	return digests, nil
+}
+
+// systemContext adds credentials of the keychain for the registry of the image, if there are any.
+// The keychain failing is not a failure of the registry, so the auth file is used instead.
+func (i *imageInspector) systemContext(ctx context.Context, ref types.ImageReference) *types.SystemContext {
+	named := ref.DockerReference()
+	if i.keychain == nil || named == nil {
+		return i.sys
+	}
+
+	auth, err := i.keychain.Credentials(ctx, dockerreference.Domain(named))
+	if err != nil {
+		log.Printf("error when getting credentials of registry %s: %s", dockerreference.Domain(named), err)
+	}
+	if auth == nil {
+		return i.sys
+	}
+
+	sys := *i.sys
+	sys.DockerAuthConfig = auth
+
+	return &sys
 }
@@ -0,0 +1,82 @@
+package engine_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/engine"
+)
+
+const (
+	amd64Digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	arm64Digest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+const ociIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "` + amd64Digest + `", "size": 1024,
+     "platform": {"architecture": "amd64", "os": "linux"}},
+    {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "` + arm64Digest + `", "size": 1024,
+     "platform": {"architecture": "arm64", "os": "linux"}}
+  ]
+}`
+
+const dockerManifestList = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "` + amd64Digest + `", "size": 1024,
+     "platform": {"architecture": "amd64", "os": "linux"}},
+    {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "` + arm64Digest + `", "size": 1024,
+     "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}}
+  ]
+}`
+
+const dockerManifest = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {
+    "mediaType": "application/vnd.docker.container.image.v1+json",
+    "digest": "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+    "size": 512
+  },
+  "layers": []
+}`
+
+func TestInspector_Digests(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		mimeType string
+		index    bool
+	}{
+		{"OCI index", ociIndex, "application/vnd.oci.image.index.v1+json", true},
+		{"Docker manifest list", dockerManifestList, "application/vnd.docker.distribution.manifest.list.v2+json", true},
+		{"Docker manifest", dockerManifest, "application/vnd.docker.distribution.manifest.v2+json", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum := sha256.Sum256([]byte(tt.raw))
+			digest := "sha256:" + hex.EncodeToString(sum[:])
+
+			digests, err := engine.DigestsFromManifest([]byte(tt.raw), tt.mimeType)
+			require.NoError(t, err)
+			require.True(t, digests.Contains(digest))
+
+			if tt.index {
+				require.Equal(t, engine.Digests{Index: digest, Manifests: []string{amd64Digest, arm64Digest}}, digests)
+			} else {
+				require.Equal(t, engine.Digests{Manifests: []string{digest}}, digests)
+				require.False(t, digests.Contains(amd64Digest))
+			}
+		})
+	}
+
+	_, err := engine.DigestsFromManifest([]byte(`{"manifests": "broken"}`), "application/vnd.oci.image.index.v1+json")
+	require.Error(t, err)
+}
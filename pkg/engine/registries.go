@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrWrongRegistriesConf = errors.New("wrong registries configuration")
+
+// RegistriesConf is the registriesConf section of the rules file. It is a subset of registries.conf,
+// so registry lookups go through the same mirrors as image pulls of nodes do.
+type RegistriesConf struct {
+	Registries []RegistryConf `yaml:"registries,omitempty"`
+	// CertsDir has host[:port] subdirectories with ca.crt and client certificates, like /etc/containers/certs.d.
+	CertsDir string `yaml:"certsDir,omitempty"`
+}
+
+type RegistryConf struct {
+	// Prefix of images the registry is used for and Location of the registry, one defaults to the other.
+	Prefix   string         `yaml:"prefix,omitempty"`
+	Location string         `yaml:"location,omitempty"`
+	Insecure bool           `yaml:"insecure,omitempty"`
+	Mirrors  []RegistryConf `yaml:"mirrors,omitempty"`
+}
+
+// registriesConfFile is the name of the drop-in written for the section, drop-ins override
+// registries of the same prefix from registries.conf.
+const registriesConfFile = "50-kiw.conf"
+
+func NewRegistriesConfFromFile(file string) (RegistriesConf, error) {
+	var config struct {
+		RegistriesConf RegistriesConf `yaml:"registriesConf"`
+	}
+
+	yamlFile, err := os.ReadFile(file)
+	if err != nil {
+		return RegistriesConf{}, err
+	}
+
+	if err := yaml.Unmarshal(yamlFile, &config); err != nil {
+		return RegistriesConf{}, err
+	}
+
+	return config.RegistriesConf, nil
+}
+
+// IsEmpty reports whether the section is not set.
+func (c RegistriesConf) IsEmpty() bool {
+	return len(c.Registries) == 0 && c.CertsDir == ""
+}
+
+// SetRegistriesConfFile makes the inspector use mirrors and insecure registries of the registries.conf file.
+func (i *imageInspector) SetRegistriesConfFile(file string) {
+	i.sys.SystemRegistriesConfPath = file
+}
+
+// SetRegistriesConf writes registries of the section as a registries.conf drop-in into the directory,
+// so they take precedence over the registries.conf file. The configuration is checked the same way
+// as it is when images are inspected.
+func (i *imageInspector) SetRegistriesConf(config RegistriesConf, dir string) error {
+	registries := make([]sysregistriesv2.Registry, len(config.Registries))
+	for n, registry := range config.Registries {
+		if registry.Prefix == "" && registry.Location == "" {
+			return fmt.Errorf("%w: registry should have prefix or location", ErrWrongRegistriesConf)
+		}
+
+		location := registry.Location
+		if location == "" && !strings.HasPrefix(registry.Prefix, "*.") {
+			location = registry.Prefix
+		}
+
+		registries[n] = sysregistriesv2.Registry{
+			Prefix:   registry.Prefix,
+			Endpoint: sysregistriesv2.Endpoint{Location: location, Insecure: registry.Insecure},
+		}
+
+		for _, mirror := range registry.Mirrors {
+			if mirror.Location == "" {
+				return fmt.Errorf("%w: mirror of registry '%s%s' should have location", ErrWrongRegistriesConf, registry.Prefix, registry.Location)
+			}
+			registries[n].Mirrors = append(registries[n].Mirrors, sysregistriesv2.Endpoint{Location: mirror.Location, Insecure: mirror.Insecure})
+		}
+	}
+
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(sysregistriesv2.V2RegistriesConf{Registries: registries}); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, registriesConfFile), b.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	sys := *i.sys
+	sys.SystemRegistriesConfDirPath = dir
+	if config.CertsDir != "" {
+		sys.DockerPerHostCertDirPath = config.CertsDir
+	}
+
+	if _, err := sysregistriesv2.TryUpdatingCache(&sys); err != nil {
+		return fmt.Errorf("%w: %s", ErrWrongRegistriesConf, err)
+	}
+
+	i.sys = &sys
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package engine_test
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/engine"
+)
+
+func TestInspector_RegistriesConf(t *testing.T) {
+	dir := t.TempDir()
+
+	// registries.conf of nodes, the section of the rules file overrides docker.io
+	confFile := filepath.Join(dir, "registries.conf")
+	err := os.WriteFile(confFile, []byte(`
+[[registry]]
+prefix = "docker.io"
+location = "docker.io"
+
+[[registry]]
+prefix = "quay.io"
+location = "quay.io"
+
+[[registry.mirror]]
+location = "quay-mirror.internal"
+`), 0o644)
+	require.NoError(t, err)
+
+	config, err := engine.NewRegistriesConfFromFile(path.Join("..", "..", "testdata", "rules.yaml"))
+	require.NoError(t, err)
+	require.False(t, config.IsEmpty())
+
+	inspector := engine.NewImageInspector(time.Second)
+	inspector.SetRegistriesConfFile(confFile)
+	err = inspector.SetRegistriesConf(config, t.TempDir())
+	require.NoError(t, err)
+
+	sys := inspector.SystemContext()
+	require.Equal(t, "/etc/kiw/certs.d", sys.DockerPerHostCertDirPath)
+
+	registry, err := sysregistriesv2.FindRegistry(sys, "docker.io/library/nginx:latest")
+	require.NoError(t, err)
+	require.Equal(t, "docker.io", registry.Location)
+	require.Len(t, registry.Mirrors, 1)
+	require.Equal(t, "mirror.internal:5000", registry.Mirrors[0].Location)
+	require.True(t, registry.Mirrors[0].Insecure)
+
+	registry, err = sysregistriesv2.FindRegistry(sys, "registry.internal/app:1.0")
+	require.NoError(t, err)
+	require.True(t, registry.Insecure)
+
+	registry, err = sysregistriesv2.FindRegistry(sys, "quay.io/app:1.0")
+	require.NoError(t, err)
+	require.Equal(t, "quay-mirror.internal", registry.Mirrors[0].Location)
+
+	t.Run("Wrong configuration", func(t *testing.T) {
+		inspector := engine.NewImageInspector(time.Second)
+
+		err := inspector.SetRegistriesConf(engine.RegistriesConf{Registries: []engine.RegistryConf{{Insecure: true}}}, t.TempDir())
+		require.ErrorIs(t, err, engine.ErrWrongRegistriesConf)
+
+		err = inspector.SetRegistriesConf(engine.RegistriesConf{Registries: []engine.RegistryConf{
+			{Prefix: "docker.io", Mirrors: []engine.RegistryConf{{Insecure: true}}},
+		}}, t.TempDir())
+		require.ErrorIs(t, err, engine.ErrWrongRegistriesConf)
+
+		err = inspector.SetRegistriesConf(engine.RegistriesConf{Registries: []engine.RegistryConf{
+			{Prefix: "*.example.com/app", Location: "example.com"},
+		}}, t.TempDir())
+		require.ErrorIs(t, err, engine.ErrWrongRegistriesConf)
+	})
+}
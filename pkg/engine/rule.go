@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/Masterminds/semver"
+	"github.com/surik/k8s-image-warden/pkg/registry"
 	"github.com/surik/k8s-image-warden/pkg/repo"
+	"gopkg.in/yaml.v3"
 )
 
 type ValidateType string
@@ -26,17 +29,60 @@ type MutationType string
 const (
 	MutationTypeDefaultRegistry MutationType = "DefaultRegistry"
 	MutationTypeRewriteRegistry MutationType = "RewriteRegistry"
+	MutationTypePullSecret      MutationType = "PullSecret"
+	MutationTypePullPolicy      MutationType = "PullPolicy"
+	MutationTypeFailover        MutationType = "Failover"
+)
+
+const DefaultPullPolicy = "Always"
+
+// RegistryFailurePolicy is the verdict of a rule which needs the registry when it is unavailable.
+// Without a policy the rule doesn't match and the next rules are evaluated.
+type RegistryFailurePolicy string
+
+const (
+	RegistryFailureAllow RegistryFailurePolicy = "Allow"
+	RegistryFailureDeny  RegistryFailurePolicy = "Deny"
+	RegistryFailureWarn  RegistryFailurePolicy = "Warn"
 )
 
 var (
-	ErrWrongRuleType = errors.New("wrong rule type")
+	ErrWrongRuleType              = errors.New("wrong rule type")
+	ErrWrongPullPolicy            = errors.New("wrong pull policy")
+	ErrWrongRegistryFailurePolicy = errors.New("wrong registry failure policy")
+	ErrRegistryUnavailable        = errors.New("registry is unavailable")
 )
 
 type MutationRule struct {
 	Type           MutationType   `yaml:"type"`
 	Registry       string         `yaml:"registry,omitempty"`
 	RegistryRegexp *regexp.Regexp `yaml:"-"`
-	NewRegistry    string         `yaml:"newRegisty,omitempty"`
+	NewRegistry    string         `yaml:"newRegistry,omitempty"`
+	ImageTag       string         `yaml:"imageTag,omitempty"`
+	ImageTagRegexp *regexp.Regexp `yaml:"-"`
+	PullSecret     string         `yaml:"pullSecret,omitempty"`
+	PullPolicy     string         `yaml:"pullPolicy,omitempty"`
+	Registries     []string       `yaml:"registries,omitempty"`
+}
+
+// UnmarshalYAML accepts newRegisty as well, the misspelled key which earlier versions expected.
+func (r *MutationRule) UnmarshalYAML(value *yaml.Node) error {
+	type plain MutationRule
+	var rule struct {
+		plain      `yaml:",inline"`
+		Misspelled string `yaml:"newRegisty,omitempty"`
+	}
+
+	if err := value.Decode(&rule); err != nil {
+		return err
+	}
+
+	*r = MutationRule(rule.plain)
+	if r.NewRegistry == "" {
+		r.NewRegistry = rule.Misspelled
+	}
+
+	return nil
 }
 
 type ValidationRule struct {
@@ -47,6 +93,10 @@ type ValidationRule struct {
 	ImageTagSemVer  *semver.Constraints `yaml:"-"`
 	Allow           bool                `yaml:"allow"`
 	RollingTagAfter time.Time           `yaml:"after,omitempty"`
+	// Annotations limit the rule to requests having all of them, an empty value matches any value.
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+
+	OnRegistryFailure RegistryFailurePolicy `yaml:"onRegistryFailure,omitempty"`
 }
 
 type Rule struct {
@@ -72,6 +122,12 @@ func (r Rule) compile() (Rule, error) {
 }
 
 func (r Rule) compileValidateRule() (Rule, error) {
+	switch r.ValidationRule.OnRegistryFailure {
+	case "", RegistryFailureAllow, RegistryFailureDeny, RegistryFailureWarn:
+	default:
+		return r, fmt.Errorf("%w: %s", ErrWrongRegistryFailurePolicy, r.ValidationRule.OnRegistryFailure)
+	}
+
 	if r.ValidationRule.Type == ValidateTypeSemVer {
 		compiled, err := semver.NewConstraint(r.ValidationRule.ImageTag)
 		if err != nil {
@@ -90,18 +146,58 @@ func (r Rule) compileValidateRule() (Rule, error) {
 }
 
 func (r Rule) compileMutateRule() (Rule, error) {
-	if r.MutationRule.Type == MutationTypeRewriteRegistry {
+	switch r.MutationRule.Type {
+	case MutationTypeRewriteRegistry:
 		compiled, err := regexp.Compile(r.MutationRule.Registry)
 		if err != nil {
 			return r, err
 		}
 		r.MutationRule.RegistryRegexp = compiled
+	case MutationTypePullSecret:
+		if r.MutationRule.PullSecret == "" {
+			return r, fmt.Errorf("%w: pullSecret is required for %s", ErrWrongRuleType, r.MutationRule.Type)
+		}
+		compiled, err := regexp.Compile(r.MutationRule.Registry)
+		if err != nil {
+			return r, err
+		}
+		r.MutationRule.RegistryRegexp = compiled
+	case MutationTypeFailover:
+		if len(r.MutationRule.Registries) == 0 {
+			return r, fmt.Errorf("%w: registries are required for %s", ErrWrongRuleType, r.MutationRule.Type)
+		}
+		if r.MutationRule.Registry != "" {
+			compiled, err := regexp.Compile(r.MutationRule.Registry)
+			if err != nil {
+				return r, err
+			}
+			r.MutationRule.RegistryRegexp = compiled
+		}
+	case MutationTypePullPolicy:
+		switch r.MutationRule.PullPolicy {
+		case "":
+			r.MutationRule.PullPolicy = DefaultPullPolicy
+		case "Always", "IfNotPresent", "Never":
+		default:
+			return r, fmt.Errorf("%w: %s", ErrWrongPullPolicy, r.MutationRule.PullPolicy)
+		}
+		compiled, err := regexp.Compile(r.MutationRule.Registry)
+		if err != nil {
+			return r, err
+		}
+		r.MutationRule.RegistryRegexp = compiled
+		compiled, err = regexp.Compile(r.MutationRule.ImageTag)
+		if err != nil {
+			return r, err
+		}
+		r.MutationRule.ImageTagRegexp = compiled
+	default:
 	}
 
 	return r, nil
 }
 
-func (r MutationRule) Mutate(domain string) (string, bool) {
+func (r MutationRule) Mutate(domain string, prober RegistryProber) (string, bool) {
 	switch r.Type {
 	case MutationTypeDefaultRegistry:
 		if domain == "" {
@@ -111,20 +207,83 @@ func (r MutationRule) Mutate(domain string) (string, bool) {
 		if r.RegistryRegexp.MatchString(domain) {
 			return r.NewRegistry, true
 		}
+	case MutationTypeFailover:
+		if r.matchFailover(domain) {
+			return r.failover(domain, prober)
+		}
 	default:
 	}
 	return domain, false
 }
 
-func (r ValidationRule) Match(ctx context.Context, repo *repo.Repo, inspector ImageInspector, name, tag string) bool {
+// matchFailover checks if the domain is covered by the failover rule.
+// Without explicit registry regexp the domain has to be one of the failover registries.
+func (r MutationRule) matchFailover(domain string) bool {
+	if r.RegistryRegexp != nil {
+		return r.RegistryRegexp.MatchString(domain)
+	}
+
+	for _, registry := range r.Registries {
+		if registry == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// failover picks the first healthy registry. The domain stays untouched when no registry is healthy.
+func (r MutationRule) failover(domain string, prober RegistryProber) (string, bool) {
+	for _, registry := range r.Registries {
+		if prober != nil && !prober.IsHealthy(registry) {
+			continue
+		}
+
+		if registry == domain {
+			return domain, false
+		}
+
+		return registry, true
+	}
+
+	return domain, false
+}
+
+// MutatePod reports whether the rule requires changes to the pod spec for an image
+// with the given domain and tag. It only applies to PullSecret and PullPolicy rules.
+func (r MutationRule) MutatePod(domain, tag string, mutation *PodMutation) bool {
+	switch r.Type {
+	case MutationTypePullSecret:
+		if r.RegistryRegexp != nil && r.RegistryRegexp.MatchString(domain) {
+			mutation.PullSecrets = append(mutation.PullSecrets, r.PullSecret)
+			return true
+		}
+	case MutationTypePullPolicy:
+		if r.RegistryRegexp != nil && r.RegistryRegexp.MatchString(domain) &&
+			r.ImageTagRegexp != nil && r.ImageTagRegexp.MatchString(tag) {
+			mutation.PullPolicy = r.PullPolicy
+			return true
+		}
+	default:
+	}
+	return false
+}
+
+// Match reports whether the rule applies to the image. The error is ErrRegistryUnavailable
+// when the rule can't be checked because the registry failed to answer.
+func (r ValidationRule) Match(ctx context.Context, repo repo.Store, inspector ImageInspector, name, tag string) (bool, error) {
+	if !r.matchAnnotations(ctx) {
+		return false, nil
+	}
+
 	switch r.Type {
 	case ValidateTypeLatest:
 		if r.matchName(name) && tag == "latest" {
-			return true
+			return true, nil
 		}
 	case ValidateTypeLock:
 		if r.matchName(name) && tag == r.ImageTag {
-			return true
+			return true, nil
 		}
 	case ValidateTypeRollingTag:
 		if r.matchName(name) {
@@ -132,21 +291,21 @@ func (r ValidationRule) Match(ctx context.Context, repo *repo.Repo, inspector Im
 		}
 	case ValidateTypeSemVer:
 		if !r.matchName(name) {
-			return false
+			return false, nil
 		}
 		version, err := semver.NewVersion(tag)
 		if err != nil {
-			return false
+			return false, nil
 		}
 		constraint := r.ImageTagSemVer
 		if constraint.Check(version) {
-			return true
+			return true, nil
 		}
 	default:
-		return false
+		return false, nil
 	}
 
-	return false
+	return false, nil
 }
 
 func (r ValidationRule) matchName(name string) bool {
@@ -162,41 +321,52 @@ func (r ValidationRule) matchName(name string) bool {
 	return false
 }
 
-func (r ValidationRule) validateRollingTag(parentCtx context.Context, repo *repo.Repo, inspector ImageInspector, name, tag string) bool {
+// recordedDigest strips the repository of repo digests reported by CRI, e.g. docker.io/library/nginx@sha256:...
+func recordedDigest(repoDigest string) string {
+	if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+		return digest
+	}
+	return repoDigest
+}
+
+func (r ValidationRule) validateRollingTag(parentCtx context.Context, repo repo.Store, inspector ImageInspector, name, tag string) (bool, error) {
 	ids, err := repo.GetIDsByNameAndAfter(name+":"+tag, r.RollingTagAfter)
 	if err != nil {
 		log.Println(err)
-		return false
+		return false, nil
 	}
 
 	if len(ids) > 1 {
-		return true
+		return true, nil
 	}
 
 	if len(ids) == 1 {
-		digests, err := repo.GetDigestsByNameAndAfter(name+":"+tag, r.RollingTagAfter)
+		recorded, err := repo.GetDigestsByNameAndAfter(name+":"+tag, r.RollingTagAfter)
 		if err != nil {
 			log.Println(err)
-			return false
+			return false, nil
 		}
 
 		ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
 		defer cancel()
 
-		digest, err := inspector.GetDigest(ctx, "docker://"+name)
+		digests, err := inspector.GetDigests(ctx, "docker://"+name+":"+tag)
 		if err != nil {
-			log.Printf("error when inspecting image %s: %s", name, err)
-			return false
+			log.Printf("error when inspecting image %s:%s: %s", name, tag, err)
+			// the registry answered, e.g. the image is unknown or credentials are wrong
+			if !registry.IsUnavailable(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("%w: %s", ErrRegistryUnavailable, err)
 		}
 
-		// could there be any others?
-		digestAlgorithm := "sha256"
-
-		// in the registry we have another image that refers to the same tag. this is a rolling tag
-		if digests[0] != digestAlgorithm+":"+digest {
-			return true
+		// in the registry the tag refers to another image than nodes have. this is a rolling tag
+		for _, digest := range recorded {
+			if digest != "" && !digests.Contains(recordedDigest(digest)) {
+				return true, nil
+			}
 		}
 	}
 
-	return false
+	return false, nil
 }
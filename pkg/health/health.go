@@ -0,0 +1,68 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkTimeout keeps readiness probes fast even when a dependency hangs.
+const checkTimeout = 3 * time.Second
+
+type Check func(context.Context) error
+
+// Checker runs named checks, the component is ready when all of them pass.
+type Checker struct {
+	names  []string
+	checks map[string]Check
+}
+
+func NewChecker() *Checker {
+	return &Checker{checks: make(map[string]Check)}
+}
+
+func (c *Checker) Add(name string, check Check) *Checker {
+	c.names = append(c.names, name)
+	c.checks[name] = check
+	return c
+}
+
+// Check returns the error of every failed check.
+func (c *Checker) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	var failures []string
+	for _, name := range c.names {
+		if err := c.checks[name](ctx); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("not ready: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// Handler responds with 503 and the failed checks if the component is not ready.
+func (c *Checker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.Check(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// LivenessHandler responds while the process is able to serve HTTP.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,38 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/health"
+)
+
+func TestChecker(t *testing.T) {
+	var repoErr error
+
+	checker := health.NewChecker().
+		Add("rules", func(context.Context) error { return nil }).
+		Add("repo", func(context.Context) error { return repoErr })
+
+	require.NoError(t, checker.Check(context.Background()))
+
+	w := httptest.NewRecorder()
+	checker.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	repoErr = errors.New("disk is full")
+	require.EqualError(t, checker.Check(context.Background()), "not ready: repo: disk is full")
+
+	w = httptest.NewRecorder()
+	checker.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Contains(t, w.Body.String(), "repo: disk is full")
+
+	w = httptest.NewRecorder()
+	health.LivenessHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", http.NoBody))
+	require.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "kiw"
+
+// Registry holds all metrics of the process. Metrics with labels are exposed only after
+// they are observed, so the agent and the controller show only their own metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	WebhookRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "requests_total",
+		Help:      "Number of admission requests by webhook and verdict.",
+	}, []string{"webhook", "verdict"})
+
+	WebhookRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of admission requests by webhook and verdict.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"webhook", "verdict"})
+
+	WebhookDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "decisions_total",
+		Help:      "Number of container image decisions by webhook, verdict and rule.",
+	}, []string{"webhook", "verdict", "rule"})
+
+	RuleHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "engine",
+		Name:      "rule_hits_total",
+		Help:      "Number of times a rule matched an image, by rule and its type.",
+	}, []string{"rule", "type"})
+
+	InspectorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "inspector",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of image manifest requests to registries by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	Reports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "controller",
+		Name:      "reports_total",
+		Help:      "Number of agent reports received by node and result.",
+	}, []string{"node", "result"})
+
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Number of cache lookups by cache and result, either hit or miss.",
+	}, []string{"cache", "result"})
+
+	CircuitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "registry",
+		Name:      "circuit_rejections_total",
+		Help:      "Number of registry calls not made because the circuit of the registry is open.",
+	}, []string{"registry"})
+
+	ShadowDifferences = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "shadow",
+		Name:      "differences_total",
+		Help:      "Number of images which verdict of the shadow rules differs, by verdict, shadow verdict and shadow rule.",
+	}, []string{"verdict", "shadow_verdict", "shadow_rule"})
+
+	AgentReports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "reports_total",
+		Help:      "Number of reports sent to controller by result.",
+	}, []string{"result"})
+
+	AgentCRIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "cri_request_duration_seconds",
+		Help:      "Duration of container runtime requests by call and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "result"})
+)
+
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		WebhookRequests,
+		WebhookRequestDuration,
+		WebhookDecisions,
+		RuleHits,
+		InspectorDuration,
+		Reports,
+		CacheRequests,
+		CircuitRejections,
+		ShadowDifferences,
+		AgentReports,
+		AgentCRIDuration,
+	)
+}
+
+// Result returns the result label value for the error.
+func Result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+
+	return ResultSuccess
+}
+
+// RecordCounter reports number of records kept in storage by table.
+type RecordCounter interface {
+	CountRecords() (map[string]int64, error)
+}
+
+type repoCollector struct {
+	counter RecordCounter
+	records *prometheus.Desc
+}
+
+// RegisterRepo exposes sizes of the repo tables, they are counted on every scrape.
+func RegisterRepo(counter RecordCounter) error {
+	return Registry.Register(&repoCollector{
+		counter: counter,
+		records: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "repo", "records"),
+			"Number of records kept in the store by table.",
+			[]string{"table"}, nil,
+		),
+	})
+}
+
+func (c *repoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.records
+}
+
+func (c *repoCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.counter.CountRecords()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.records, err)
+		return
+	}
+
+	for table, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.records, prometheus.GaugeValue, float64(count), table)
+	}
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+type Server struct {
+	endpoint string
+	mux      *http.ServeMux
+	srv      *http.Server
+}
+
+func NewServer(endpoint string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	return &Server{
+		endpoint: endpoint,
+		mux:      mux,
+		srv: &http.Server{
+			Addr:    endpoint,
+			Handler: mux,
+		},
+	}
+}
+
+// Handle serves additional endpoints next to metrics, it has to be called before Run.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) Run() {
+	log.Printf("Listening metrics on %s", s.endpoint)
+	if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+func (s *Server) Stop() {
+	if err := s.srv.Close(); err != nil {
+		log.Println(err)
+	}
+	log.Println("Metrics Server was shutdown")
+}
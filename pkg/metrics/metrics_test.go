@@ -0,0 +1,38 @@
+package metrics_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
+	helpers "github.com/surik/k8s-image-warden/pkg/metrics/testing"
+)
+
+type recordCounter map[string]int64
+
+func (c recordCounter) CountRecords() (map[string]int64, error) {
+	return c, nil
+}
+
+func TestMetrics(t *testing.T) {
+	err := metrics.RegisterRepo(recordCounter{"decisions": 42, "nodes": 3})
+	require.NoError(t, err)
+
+	metrics.AgentReports.WithLabelValues(metrics.Result(nil)).Inc()
+	metrics.AgentReports.WithLabelValues(metrics.Result(errors.New("unavailable"))).Inc()
+	metrics.AgentCRIDuration.WithLabelValues("ListImages", metrics.ResultSuccess).Observe(time.Second.Seconds())
+
+	body := helpers.Scrape(t)
+
+	require.Contains(t, body, `kiw_repo_records{table="decisions"} 42`)
+	require.Contains(t, body, `kiw_repo_records{table="nodes"} 3`)
+	require.Contains(t, body, `kiw_agent_reports_total{result="success"} 1`)
+	require.Contains(t, body, `kiw_agent_reports_total{result="error"} 1`)
+	require.Contains(t, body, `kiw_agent_cri_request_duration_seconds_count{call="ListImages",result="success"} 1`)
+	require.Contains(t, body, "go_goroutines")
+
+	// metrics which were not observed are not exposed
+	require.NotContains(t, body, "kiw_webhook_requests_total")
+}
@@ -0,0 +1,30 @@
+package testing
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/metrics"
+)
+
+// Scrape returns metrics of the process in the text exposition format.
+func Scrape(t *testing.T) string {
+	t.Helper()
+
+	srv := httptest.NewServer(metrics.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(body)
+}
@@ -19,11 +19,17 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	ControllerService_Report_FullMethodName    = "/proto.ControllerService/Report"
-	ControllerService_GetReport_FullMethodName = "/proto.ControllerService/GetReport"
-	ControllerService_GetRules_FullMethodName  = "/proto.ControllerService/GetRules"
-	ControllerService_Validate_FullMethodName  = "/proto.ControllerService/Validate"
-	ControllerService_Mutate_FullMethodName    = "/proto.ControllerService/Mutate"
+	ControllerService_Report_FullMethodName         = "/proto.ControllerService/Report"
+	ControllerService_GetReport_FullMethodName      = "/proto.ControllerService/GetReport"
+	ControllerService_GetRules_FullMethodName       = "/proto.ControllerService/GetRules"
+	ControllerService_Validate_FullMethodName       = "/proto.ControllerService/Validate"
+	ControllerService_Mutate_FullMethodName         = "/proto.ControllerService/Mutate"
+	ControllerService_GetRegistries_FullMethodName  = "/proto.ControllerService/GetRegistries"
+	ControllerService_Evaluate_FullMethodName       = "/proto.ControllerService/Evaluate"
+	ControllerService_ValidateImages_FullMethodName = "/proto.ControllerService/ValidateImages"
+	ControllerService_GetDecisions_FullMethodName   = "/proto.ControllerService/GetDecisions"
+	ControllerService_VerifyAudit_FullMethodName    = "/proto.ControllerService/VerifyAudit"
+	ControllerService_ExportAudit_FullMethodName    = "/proto.ControllerService/ExportAudit"
 )
 
 // ControllerServiceClient is the client API for ControllerService service.
@@ -35,6 +41,12 @@ type ControllerServiceClient interface {
 	GetRules(ctx context.Context, in *GetRulesRequest, opts ...grpc.CallOption) (*GetRulesResponse, error)
 	Validate(ctx context.Context, in *ValidateRequest, opts ...grpc.CallOption) (*ValidateResponse, error)
 	Mutate(ctx context.Context, in *MutateRequest, opts ...grpc.CallOption) (*MutateResponse, error)
+	GetRegistries(ctx context.Context, in *GetRegistriesRequest, opts ...grpc.CallOption) (*GetRegistriesResponse, error)
+	Evaluate(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error)
+	ValidateImages(ctx context.Context, in *ValidateImagesRequest, opts ...grpc.CallOption) (*ValidateImagesResponse, error)
+	GetDecisions(ctx context.Context, in *GetDecisionsRequest, opts ...grpc.CallOption) (*GetDecisionsResponse, error)
+	VerifyAudit(ctx context.Context, in *VerifyAuditRequest, opts ...grpc.CallOption) (*VerifyAuditResponse, error)
+	ExportAudit(ctx context.Context, in *ExportAuditRequest, opts ...grpc.CallOption) (*ExportAuditResponse, error)
 }
 
 type controllerServiceClient struct {
@@ -90,6 +102,60 @@ func (c *controllerServiceClient) Mutate(ctx context.Context, in *MutateRequest,
 	return out, nil
 }
 
+func (c *controllerServiceClient) GetRegistries(ctx context.Context, in *GetRegistriesRequest, opts ...grpc.CallOption) (*GetRegistriesResponse, error) {
+	out := new(GetRegistriesResponse)
+	err := c.cc.Invoke(ctx, ControllerService_GetRegistries_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) Evaluate(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error) {
+	out := new(EvaluateResponse)
+	err := c.cc.Invoke(ctx, ControllerService_Evaluate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) ValidateImages(ctx context.Context, in *ValidateImagesRequest, opts ...grpc.CallOption) (*ValidateImagesResponse, error) {
+	out := new(ValidateImagesResponse)
+	err := c.cc.Invoke(ctx, ControllerService_ValidateImages_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) GetDecisions(ctx context.Context, in *GetDecisionsRequest, opts ...grpc.CallOption) (*GetDecisionsResponse, error) {
+	out := new(GetDecisionsResponse)
+	err := c.cc.Invoke(ctx, ControllerService_GetDecisions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) VerifyAudit(ctx context.Context, in *VerifyAuditRequest, opts ...grpc.CallOption) (*VerifyAuditResponse, error) {
+	out := new(VerifyAuditResponse)
+	err := c.cc.Invoke(ctx, ControllerService_VerifyAudit_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) ExportAudit(ctx context.Context, in *ExportAuditRequest, opts ...grpc.CallOption) (*ExportAuditResponse, error) {
+	out := new(ExportAuditResponse)
+	err := c.cc.Invoke(ctx, ControllerService_ExportAudit_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ControllerServiceServer is the server API for ControllerService service.
 // All implementations must embed UnimplementedControllerServiceServer
 // for forward compatibility
@@ -99,6 +165,12 @@ type ControllerServiceServer interface {
 	GetRules(context.Context, *GetRulesRequest) (*GetRulesResponse, error)
 	Validate(context.Context, *ValidateRequest) (*ValidateResponse, error)
 	Mutate(context.Context, *MutateRequest) (*MutateResponse, error)
+	GetRegistries(context.Context, *GetRegistriesRequest) (*GetRegistriesResponse, error)
+	Evaluate(context.Context, *EvaluateRequest) (*EvaluateResponse, error)
+	ValidateImages(context.Context, *ValidateImagesRequest) (*ValidateImagesResponse, error)
+	GetDecisions(context.Context, *GetDecisionsRequest) (*GetDecisionsResponse, error)
+	VerifyAudit(context.Context, *VerifyAuditRequest) (*VerifyAuditResponse, error)
+	ExportAudit(context.Context, *ExportAuditRequest) (*ExportAuditResponse, error)
 	mustEmbedUnimplementedControllerServiceServer()
 }
 
@@ -121,6 +193,24 @@ func (UnimplementedControllerServiceServer) Validate(context.Context, *ValidateR
 func (UnimplementedControllerServiceServer) Mutate(context.Context, *MutateRequest) (*MutateResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Mutate not implemented")
 }
+func (UnimplementedControllerServiceServer) GetRegistries(context.Context, *GetRegistriesRequest) (*GetRegistriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRegistries not implemented")
+}
+func (UnimplementedControllerServiceServer) Evaluate(context.Context, *EvaluateRequest) (*EvaluateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Evaluate not implemented")
+}
+func (UnimplementedControllerServiceServer) ValidateImages(context.Context, *ValidateImagesRequest) (*ValidateImagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ValidateImages not implemented")
+}
+func (UnimplementedControllerServiceServer) GetDecisions(context.Context, *GetDecisionsRequest) (*GetDecisionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDecisions not implemented")
+}
+func (UnimplementedControllerServiceServer) VerifyAudit(context.Context, *VerifyAuditRequest) (*VerifyAuditResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyAudit not implemented")
+}
+func (UnimplementedControllerServiceServer) ExportAudit(context.Context, *ExportAuditRequest) (*ExportAuditResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportAudit not implemented")
+}
 func (UnimplementedControllerServiceServer) mustEmbedUnimplementedControllerServiceServer() {}
 
 // UnsafeControllerServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -224,6 +314,114 @@ func _ControllerService_Mutate_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ControllerService_GetRegistries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRegistriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).GetRegistries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_GetRegistries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).GetRegistries(ctx, req.(*GetRegistriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_Evaluate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EvaluateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).Evaluate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_Evaluate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).Evaluate(ctx, req.(*EvaluateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_ValidateImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidateImagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).ValidateImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_ValidateImages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).ValidateImages(ctx, req.(*ValidateImagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_GetDecisions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDecisionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).GetDecisions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_GetDecisions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).GetDecisions(ctx, req.(*GetDecisionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_VerifyAudit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyAuditRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).VerifyAudit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_VerifyAudit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).VerifyAudit(ctx, req.(*VerifyAuditRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_ExportAudit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportAuditRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).ExportAudit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_ExportAudit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).ExportAudit(ctx, req.(*ExportAuditRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // ControllerService_ServiceDesc is the grpc.ServiceDesc for ControllerService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -251,6 +449,30 @@ var ControllerService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Mutate",
 			Handler:    _ControllerService_Mutate_Handler,
 		},
+		{
+			MethodName: "GetRegistries",
+			Handler:    _ControllerService_GetRegistries_Handler,
+		},
+		{
+			MethodName: "Evaluate",
+			Handler:    _ControllerService_Evaluate_Handler,
+		},
+		{
+			MethodName: "ValidateImages",
+			Handler:    _ControllerService_ValidateImages_Handler,
+		},
+		{
+			MethodName: "GetDecisions",
+			Handler:    _ControllerService_GetDecisions_Handler,
+		},
+		{
+			MethodName: "VerifyAudit",
+			Handler:    _ControllerService_VerifyAudit_Handler,
+		},
+		{
+			MethodName: "ExportAudit",
+			Handler:    _ControllerService_ExportAudit_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/proto/api.proto",
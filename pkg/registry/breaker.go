@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/metrics"
+)
+
+var ErrCircuitOpen = errors.New("circuit is open")
+
+// serverErrorStatus matches 5xx responses in errors of containers/image, as their types are not exported.
+var serverErrorStatus = regexp.MustCompile(`(?:unexpected HTTP status:|invalid status code from registry) 5\d\d\b`)
+
+// Breaker stops calls to a registry after a number of consecutive failures. Once the cool-down
+// passed a single call is let through, its success closes the circuit and its failure opens it again.
+type Breaker struct {
+	failures int
+	cooldown time.Duration
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	now      func() time.Time
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewBreaker(failures int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		failures: failures,
+		cooldown: cooldown,
+		circuits: make(map[string]*circuit),
+		now:      time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen if the registry should not be called.
+func (b *Breaker) Allow(registry string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[registry]
+	if !ok || c.failures < b.failures {
+		return nil
+	}
+
+	if !c.probing && b.now().Sub(c.openedAt) >= b.cooldown {
+		c.probing = true
+		return nil
+	}
+
+	metrics.CircuitRejections.WithLabelValues(registry).Inc()
+	return fmt.Errorf("%w for %s after %d failures", ErrCircuitOpen, registry, c.failures)
+}
+
+// Report records the result of the registry call. Only failures of the registry are counted,
+// any other error means the registry answered, see IsUnavailable.
+func (b *Breaker) Report(registry string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !IsUnavailable(err) {
+		delete(b.circuits, registry)
+		return
+	}
+
+	c, ok := b.circuits[registry]
+	if !ok {
+		c = &circuit{}
+		b.circuits[registry] = c
+	}
+
+	c.failures++
+	c.probing = false
+	if c.failures >= b.failures {
+		c.openedAt = b.now()
+	}
+}
+
+func (b *Breaker) IsOpen(registry string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[registry]
+	return ok && c.failures >= b.failures
+}
+
+// IsUnavailable reports whether the error of a registry call means the registry failed to answer: the call
+// timed out, failed in transport or got a 5xx response. Client errors, e.g. unauthorized or unknown manifest, don't.
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr):
+		return true
+	}
+
+	return serverErrorStatus.MatchString(err.Error())
+}
@@ -0,0 +1,79 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/registry"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := registry.NewBreaker(2, time.Minute)
+	breaker.SetNow(func() time.Time { return now })
+
+	failure := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// a single failure keeps the circuit closed
+	require.NoError(t, breaker.Allow("quay.io"))
+	breaker.Report("quay.io", failure)
+	require.False(t, breaker.IsOpen("quay.io"))
+	require.NoError(t, breaker.Allow("quay.io"))
+
+	// the registry answered, so the failures don't add up
+	breaker.Report("quay.io", errors.New("reading manifest 1.0 in quay.io/app: manifest unknown"))
+	require.NoError(t, breaker.Allow("quay.io"))
+	breaker.Report("quay.io", failure)
+	require.False(t, breaker.IsOpen("quay.io"))
+
+	// circuit opens after consecutive failures and only for the failing registry
+	breaker.Report("quay.io", failure)
+	require.True(t, breaker.IsOpen("quay.io"))
+	require.ErrorIs(t, breaker.Allow("quay.io"), registry.ErrCircuitOpen)
+	require.NoError(t, breaker.Allow("docker.io"))
+
+	// after the cool-down only one probe goes through
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.Allow("quay.io"))
+	require.ErrorIs(t, breaker.Allow("quay.io"), registry.ErrCircuitOpen)
+
+	// failed probe opens the circuit for another cool-down
+	breaker.Report("quay.io", failure)
+	require.ErrorIs(t, breaker.Allow("quay.io"), registry.ErrCircuitOpen)
+
+	// successful probe closes the circuit
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.Allow("quay.io"))
+	breaker.Report("quay.io", nil)
+	require.False(t, breaker.IsOpen("quay.io"))
+	require.NoError(t, breaker.Allow("quay.io"))
+	require.NoError(t, breaker.Allow("quay.io"))
+}
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		err         error
+		unavailable bool
+	}{
+		{nil, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{fmt.Errorf("pinging container registry quay.io: %w", &net.DNSError{Err: "no such host", Name: "quay.io"}), true},
+		{fmt.Errorf("reading manifest: %w", context.DeadlineExceeded), true},
+		{fmt.Errorf("%w for quay.io after 3 failures", registry.ErrCircuitOpen), true},
+		{errors.New("reading manifest 1.0 in quay.io/app: received unexpected HTTP status: 503 Service Unavailable"), true},
+		{errors.New("Requesting bearer token: invalid status code from registry 502 (Bad Gateway)"), true},
+		{errors.New("reading manifest 1.0 in quay.io/app: manifest unknown"), false},
+		{errors.New("reading manifest 1.0 in quay.io/app: unauthorized: authentication required"), false},
+		{errors.New("reading manifest 1.0 in quay.io/app: denied: requested access to the resource is denied"), false},
+		{errors.New("Requesting bearer token: invalid status code from registry 403 (Forbidden)"), false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.unavailable, registry.IsUnavailable(tt.err), "%v", tt.err)
+	}
+}
@@ -0,0 +1,7 @@
+package registry
+
+import "time"
+
+func (b *Breaker) SetNow(now func() time.Time) {
+	b.now = now
+}
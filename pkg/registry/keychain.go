@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/surik/k8s-image-warden/pkg/cache"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrBadPullSecret never wraps the parsing error, so no part of the secret ends up in logs.
+var ErrBadPullSecret = errors.New("bad pull secret")
+
+const defaultServiceAccount = "default"
+
+// PullSecrets of the pod being admitted, they are looked up in its namespace.
+type PullSecrets struct {
+	Namespace      string
+	ServiceAccount string
+	Names          []string
+}
+
+// pullSecretsTTL is how long pull secrets are kept, so admissions of a scaled up workload don't read them
+// for every pod. Changed secrets are used once it passed.
+const pullSecretsTTL = 10 * time.Second
+
+const pullSecretsCacheSize = 1024
+
+// pullSecretsTimeout bounds reading of pull secrets, which is shared by concurrent admissions.
+const pullSecretsTimeout = 5 * time.Second
+
+type pullSecretsKey struct{}
+
+// requestSecrets are pull secrets of a request along with credentials already found in them,
+// so credentials of a registry are looked up once per request.
+type requestSecrets struct {
+	PullSecrets
+	mu          sync.Mutex
+	credentials map[string]*types.DockerAuthConfig
+}
+
+// WithPullSecrets makes pull secrets of the pod available to the keychain.
+func WithPullSecrets(ctx context.Context, secrets PullSecrets) context.Context {
+	return context.WithValue(ctx, pullSecretsKey{}, &requestSecrets{
+		PullSecrets: secrets,
+		credentials: make(map[string]*types.DockerAuthConfig),
+	})
+}
+
+func pullSecretsFromContext(ctx context.Context) (*requestSecrets, bool) {
+	secrets, ok := ctx.Value(pullSecretsKey{}).(*requestSecrets)
+	return secrets, ok && secrets.Namespace != ""
+}
+
+// cacheKey identifies the pull secrets, names of Kubernetes objects contain neither '/' nor ','.
+func (s PullSecrets) cacheKey() string {
+	return s.Namespace + "/" + s.ServiceAccount + "/" + strings.Join(s.Names, ",")
+}
+
+// Keychain finds registry credentials in pull secrets of the pod and of its service account,
+// the same way as kubelet does when it pulls images of the pod.
+type Keychain struct {
+	client  kubernetes.Interface
+	configs *cache.Cache[[]dockerConfig]
+}
+
+func NewKeychain(client kubernetes.Interface) *Keychain {
+	return &Keychain{
+		client:  client,
+		configs: cache.New[[]dockerConfig]("pull-secrets", pullSecretsCacheSize, pullSecretsTTL),
+	}
+}
+
+// Credentials returns credentials of the registry from the first pull secret having them,
+// secrets of the pod go before secrets of its service account. Missing secrets are skipped.
+func (k *Keychain) Credentials(ctx context.Context, registry string) (*types.DockerAuthConfig, error) {
+	secrets, ok := pullSecretsFromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	if auth, ok := secrets.credentials[registry]; ok {
+		return auth, nil
+	}
+
+	configs, err := k.configs.Get(ctx, secrets.cacheKey(), func(ctx context.Context) ([]dockerConfig, error) {
+		ctx, cancel := context.WithTimeout(ctx, pullSecretsTimeout)
+		defer cancel()
+
+		return k.dockerConfigs(ctx, secrets.PullSecrets)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var auth *types.DockerAuthConfig
+	for _, config := range configs {
+		if found, ok := config.lookup(registry); ok {
+			auth = found
+			break
+		}
+	}
+
+	secrets.credentials[registry] = auth
+	return auth, nil
+}
+
+// dockerConfigs reads pull secrets in the order their credentials are looked up.
+func (k *Keychain) dockerConfigs(ctx context.Context, secrets PullSecrets) ([]dockerConfig, error) {
+	names, err := k.secretNames(ctx, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]dockerConfig, 0, len(names))
+	for _, name := range names {
+		secret, err := k.client.CoreV1().Secrets(secrets.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		auths, err := dockerConfigAuths(secret)
+		if err != nil {
+			log.Printf("pull secret %s/%s is skipped: %s", secrets.Namespace, name, err)
+			continue
+		}
+
+		configs = append(configs, auths)
+	}
+
+	return configs, nil
+}
+
+func (k *Keychain) secretNames(ctx context.Context, secrets PullSecrets) ([]string, error) {
+	names := append([]string(nil), secrets.Names...)
+
+	account := secrets.ServiceAccount
+	if account == "" {
+		account = defaultServiceAccount
+	}
+
+	serviceAccount, err := k.client.CoreV1().ServiceAccounts(secrets.Namespace).Get(ctx, account, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range serviceAccount.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+
+	return names, nil
+}
+
+type dockerConfigEntry struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfig maps registries to their credentials.
+type dockerConfig map[string]dockerConfigEntry
+
+// dockerConfigAuths reads kubernetes.io/dockerconfigjson and legacy kubernetes.io/dockercfg secrets.
+func dockerConfigAuths(secret *corev1.Secret) (dockerConfig, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config struct {
+			Auths dockerConfig `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return nil, fmt.Errorf("%w: %s is not valid", ErrBadPullSecret, corev1.DockerConfigJsonKey)
+		}
+		return config.Auths, nil
+	case corev1.SecretTypeDockercfg:
+		var config dockerConfig
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &config); err != nil {
+			return nil, fmt.Errorf("%w: %s is not valid", ErrBadPullSecret, corev1.DockerConfigKey)
+		}
+		return config, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected type %s", ErrBadPullSecret, secret.Type)
+	}
+}
+
+func (c dockerConfig) lookup(registry string) (*types.DockerAuthConfig, bool) {
+	for key, entry := range c {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+
+		auth := &types.DockerAuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+		}
+
+		if auth.Username == "" && entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				continue
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+
+		return auth, true
+	}
+
+	return nil, false
+}
+
+// normalizeRegistry turns keys of docker config, e.g. https://index.docker.io/v1/, into registry domains.
+func normalizeRegistry(key string) string {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	key, _, _ = strings.Cut(key, "/")
+
+	switch key {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	default:
+		return key
+	}
+}
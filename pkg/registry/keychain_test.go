@@ -0,0 +1,161 @@
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKeychain(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "private", Namespace: "apps"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+				`{"auths": {"https://registry.example.com/v2/": {"username": "pod", "password": "pod-secret"}}}`)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "apps"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths": "broken-secret`)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: "apps"},
+			Type:       corev1.SecretTypeDockercfg,
+			Data: map[string][]byte{corev1.DockerConfigKey: []byte(
+				`{"https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("account:account-secret")) + `"}}`)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "apps"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+				`{"auths": {"registry.example.com": {"username": "account", "password": "account-secret"}}}`)},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "apps"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "hub"}, {Name: "example"}},
+		},
+	)
+
+	keychain := registry.NewKeychain(client)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		registry string
+		expected *types.DockerAuthConfig
+	}{
+		{
+			name:     "No pull secrets",
+			ctx:      context.Background(),
+			registry: "registry.example.com",
+		},
+		{
+			name: "Pod secrets go first",
+			ctx: registry.WithPullSecrets(context.Background(), registry.PullSecrets{
+				Namespace: "apps",
+				Names:     []string{"missing", "broken", "private"},
+			}),
+			registry: "registry.example.com",
+			expected: &types.DockerAuthConfig{Username: "pod", Password: "pod-secret"},
+		},
+		{
+			name: "Service account secrets",
+			ctx: registry.WithPullSecrets(context.Background(), registry.PullSecrets{
+				Namespace: "apps",
+				Names:     []string{"private"},
+			}),
+			registry: "docker.io",
+			expected: &types.DockerAuthConfig{Username: "account", Password: "account-secret"},
+		},
+		{
+			name: "Missing service account",
+			ctx: registry.WithPullSecrets(context.Background(), registry.PullSecrets{
+				Namespace:      "apps",
+				ServiceAccount: "builder",
+			}),
+			registry: "docker.io",
+		},
+		{
+			name: "Other namespace",
+			ctx: registry.WithPullSecrets(context.Background(), registry.PullSecrets{
+				Namespace: "default",
+				Names:     []string{"private"},
+			}),
+			registry: "registry.example.com",
+		},
+		{
+			name: "No credentials of the registry",
+			ctx: registry.WithPullSecrets(context.Background(), registry.PullSecrets{
+				Namespace: "apps",
+				Names:     []string{"private"},
+			}),
+			registry: "quay.io",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := keychain.Credentials(tt.ctx, tt.registry)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, auth)
+		})
+	}
+
+	// broken secrets are reported without their content
+	require.Contains(t, logs.String(), "pull secret apps/broken is skipped")
+	require.NotContains(t, logs.String(), "broken-secret")
+}
+
+func TestKeychain_Cache(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "private", Namespace: "apps"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+				`{"auths": {"registry.example.com": {"username": "pod", "password": "pod-secret"}}}`)},
+		},
+	)
+
+	keychain := registry.NewKeychain(client)
+	secrets := registry.PullSecrets{Namespace: "apps", Names: []string{"private"}}
+	expected := &types.DockerAuthConfig{Username: "pod", Password: "pod-secret"}
+
+	// the service account and the secret are read once per request
+	ctx := registry.WithPullSecrets(context.Background(), secrets)
+	for i := 0; i < 3; i++ {
+		auth, err := keychain.Credentials(ctx, "registry.example.com")
+		require.NoError(t, err)
+		require.Equal(t, expected, auth)
+	}
+	require.Len(t, client.Actions(), 2)
+
+	// and are kept for requests with the same pull secrets
+	auth, err := keychain.Credentials(registry.WithPullSecrets(context.Background(), secrets), "registry.example.com")
+	require.NoError(t, err)
+	require.Equal(t, expected, auth)
+
+	auth, err = keychain.Credentials(registry.WithPullSecrets(context.Background(), secrets), "quay.io")
+	require.NoError(t, err)
+	require.Nil(t, auth)
+	require.Len(t, client.Actions(), 2)
+
+	// other pull secrets are read on their own
+	_, err = keychain.Credentials(registry.WithPullSecrets(context.Background(), registry.PullSecrets{Namespace: "apps"}), "registry.example.com")
+	require.NoError(t, err)
+	require.Len(t, client.Actions(), 3)
+}
@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DockerHubRegistry is the name used in image references while the registry API is served by DockerHubAPIHost.
+const (
+	DockerHubRegistry = "docker.io"
+	DockerHubAPIHost  = "registry-1.docker.io"
+)
+
+const probeTimeout = 5 * time.Second
+
+type Status struct {
+	Registry    string
+	Healthy     bool
+	LastChecked time.Time
+	Error       string
+}
+
+// Prober periodically checks registries via their /v2/ endpoint and caches the results.
+type Prober struct {
+	registries []string
+	interval   time.Duration
+	client     *http.Client
+	mu         sync.RWMutex
+	status     map[string]Status
+	doneCh     chan bool
+}
+
+func NewProber(registries []string, interval time.Duration, client *http.Client) *Prober {
+	if client == nil {
+		client = &http.Client{Timeout: probeTimeout}
+	}
+
+	return &Prober{
+		registries: registries,
+		interval:   interval,
+		client:     client,
+		status:     make(map[string]Status, len(registries)),
+		doneCh:     make(chan bool),
+	}
+}
+
+func (p *Prober) Run() {
+	if len(p.registries) == 0 {
+		return
+	}
+
+	go func() {
+		p.Probe(context.Background())
+
+		for {
+			select {
+			case <-p.doneCh:
+				return
+			case <-time.After(p.interval):
+				p.Probe(context.Background())
+			}
+		}
+	}()
+}
+
+func (p *Prober) Stop() {
+	if len(p.registries) == 0 {
+		return
+	}
+
+	p.doneCh <- true
+	log.Println("Registry Prober was shutdown")
+}
+
+// Probe checks all registries once.
+func (p *Prober) Probe(ctx context.Context) {
+	for _, registry := range p.registries {
+		status := Status{
+			Registry:    registry,
+			Healthy:     true,
+			LastChecked: time.Now().UTC(),
+		}
+
+		if err := p.probe(ctx, registry); err != nil {
+			status.Healthy = false
+			status.Error = err.Error()
+		}
+
+		p.mu.Lock()
+		previous, known := p.status[registry]
+		p.status[registry] = status
+		p.mu.Unlock()
+
+		if !known || previous.Healthy != status.Healthy {
+			log.Printf("registry %s healthy: %t %s", registry, status.Healthy, status.Error)
+		}
+	}
+}
+
+func (p *Prober) probe(ctx context.Context, registry string) error {
+	host := registry
+	if host == DockerHubRegistry {
+		host = DockerHubAPIHost
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/v2/", http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 401 means that the registry is up but requires authentication
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// IsHealthy returns the last known health state. Registries which were never probed are considered healthy.
+func (p *Prober) IsHealthy(registry string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status, ok := p.status[registry]
+	if !ok {
+		return true
+	}
+
+	return status.Healthy
+}
+
+func (p *Prober) GetStatus() []Status {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(p.registries))
+	for _, registry := range p.registries {
+		status, ok := p.status[registry]
+		if !ok {
+			status = Status{Registry: registry, Healthy: true}
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Registry < statuses[j].Registry
+	})
+
+	return statuses
+}
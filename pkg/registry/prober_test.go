@@ -0,0 +1,63 @@
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/registry"
+)
+
+func newRegistry(t *testing.T, code int) (*httptest.Server, string) {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, strings.TrimPrefix(srv.URL, "https://")
+}
+
+func TestProber(t *testing.T) {
+	healthy, healthyHost := newRegistry(t, http.StatusOK)
+	_, authHost := newRegistry(t, http.StatusUnauthorized)
+	_, brokenHost := newRegistry(t, http.StatusServiceUnavailable)
+	down, downHost := newRegistry(t, http.StatusOK)
+	down.Close()
+
+	registries := []string{healthyHost, authHost, brokenHost, downHost}
+	prober := registry.NewProber(registries, 0, healthy.Client())
+
+	// never probed registries are considered healthy
+	for _, host := range registries {
+		require.True(t, prober.IsHealthy(host))
+	}
+	for _, status := range prober.GetStatus() {
+		require.True(t, status.Healthy)
+		require.True(t, status.LastChecked.IsZero())
+	}
+
+	prober.Probe(context.Background())
+
+	require.True(t, prober.IsHealthy(healthyHost))
+	require.True(t, prober.IsHealthy(authHost))
+	require.False(t, prober.IsHealthy(brokenHost))
+	require.False(t, prober.IsHealthy(downHost))
+
+	statuses := prober.GetStatus()
+	require.Len(t, statuses, len(registries))
+	for _, status := range statuses {
+		require.False(t, status.LastChecked.IsZero())
+		if status.Registry == brokenHost {
+			require.Contains(t, status.Error, "503")
+		}
+	}
+}
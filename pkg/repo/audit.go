@@ -0,0 +1,312 @@
+package repo
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/audit"
+	"gorm.io/gorm"
+)
+
+// AuditRecord is a stored link of the audit chain, see audit.Record.
+type AuditRecord struct {
+	ID        uint64 `gorm:"primarykey"`
+	Timestamp int64  `gorm:"index"`
+	Kind      string `gorm:"index"`
+	Data      string
+	PrevHash  string
+	Hash      string
+}
+
+// RulesChange is the data of an audit record of kind rules.
+type RulesChange struct {
+	Source string `json:"source"`
+	Digest string `json:"digest"`
+	Rules  string `json:"rules"`
+}
+
+// AuditCheckpoint is the data of an audit record of kind checkpoint. It names the last record removed
+// by retention, which the first remaining record follows.
+type AuditCheckpoint struct {
+	ID   uint64 `json:"id"`
+	Hash string `json:"hash"`
+}
+
+// auditLockID is the PostgreSQL advisory lock taken by transactions extending the audit chain.
+const auditLockID = 0x6b6977
+
+func (r AuditRecord) toAudit() audit.Record {
+	return audit.Record(r)
+}
+
+// lockAuditChain serializes appends to the audit chain of controller replicas sharing a PostgreSQL
+// database, auditMu only covers a single process. The lock is released with the transaction.
+func lockAuditChain(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", auditLockID).Error
+}
+
+// appendAuditRecords chains the records to the last stored one. It must be called with auditMu
+// held and the chain locked, as the last hash is read and extended within the transaction.
+func appendAuditRecords(tx *gorm.DB, kind string, data []string) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var last AuditRecord
+	result := tx.Order("id desc").Limit(1).Find(&last)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	records := chainAuditRecords(last.Hash, kind, data)
+
+	return tx.Create(&records).Error
+}
+
+// pruneAuditRecords removes records up to the last one made before the time. A checkpoint naming the last
+// removed record is appended first, so the remaining chain is verified to start where the removed one ended.
+// It must be called with auditMu held, the chain is locked within the transaction.
+func pruneAuditRecords(tx *gorm.DB, before time.Time) error {
+	if err := lockAuditChain(tx); err != nil {
+		return err
+	}
+
+	var last AuditRecord
+	result := tx.Where("timestamp <= ?", before.UnixNano()).Order("id desc").Limit(1).Find(&last)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	// the chain starts with the checkpoint of the previous removal and heads signing it, there is nothing else to remove
+	var recorded int64
+	err := tx.Model(&AuditRecord{}).Where("id <= ? AND kind NOT IN ?", last.ID, []string{audit.KindCheckpoint, audit.KindHead}).
+		Count(&recorded).Error
+	if err != nil || recorded == 0 {
+		return err
+	}
+
+	if err := appendAuditRecords(tx, audit.KindCheckpoint, []string{checkpointData(last)}); err != nil {
+		return err
+	}
+
+	return tx.Delete(&AuditRecord{}, "id <= ?", last.ID).Error
+}
+
+func checkpointData(last AuditRecord) string {
+	data, _ := json.Marshal(AuditCheckpoint{ID: last.ID, Hash: last.Hash})
+	return string(data)
+}
+
+// chainAuditRecords makes records of the data following the record with the given hash, IDs are left to the store.
+func chainAuditRecords(prevHash string, kind string, data []string) []AuditRecord {
+	records := make([]AuditRecord, len(data))
+	for i := range data {
+		record := audit.Record{
+			Timestamp: time.Now().UTC().UnixNano(),
+			Kind:      kind,
+			Data:      data[i],
+			PrevHash:  prevHash,
+		}
+		record.Hash = record.ComputeHash()
+		prevHash = record.Hash
+
+		records[i] = AuditRecord(record)
+	}
+
+	return records
+}
+
+func decisionsAuditData(decisions []Decision) ([]string, error) {
+	data := make([]string, len(decisions))
+	for i := range decisions {
+		bytes, err := json.Marshal(decisions[i])
+		if err != nil {
+			return nil, err
+		}
+		data[i] = string(bytes)
+	}
+
+	return data, nil
+}
+
+// StoreRulesChange records the rules into the audit chain unless they are the same as the last recorded ones.
+func (r Repo) StoreRulesChange(source string, rules []byte) (bool, error) {
+	change := newRulesChange(source, rules)
+
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	stored := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAuditChain(tx); err != nil {
+			return err
+		}
+
+		var last AuditRecord
+		result := tx.Where("kind = ?", audit.KindRules).Order("id desc").Limit(1).Find(&last)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected > 0 && change.sameAs(last) {
+			return nil
+		}
+
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+
+		stored = true
+		return appendAuditRecords(tx, audit.KindRules, []string{string(data)})
+	})
+
+	return stored && err == nil, err
+}
+
+func newRulesChange(source string, rules []byte) RulesChange {
+	sum := sha256.Sum256(rules)
+	return RulesChange{Source: source, Digest: hex.EncodeToString(sum[:]), Rules: string(rules)}
+}
+
+// sameAs reports whether the record of kind rules has the same rules.
+func (c RulesChange) sameAs(record AuditRecord) bool {
+	var change RulesChange
+	err := json.Unmarshal([]byte(record.Data), &change)
+	return err == nil && change.Digest == c.Digest
+}
+
+// SignAuditHead appends a head signing the last record, unless the chain is empty or already ends with a head.
+func (r Repo) SignAuditHead(key ed25519.PrivateKey) (*audit.Head, error) {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	var head *audit.Head
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAuditChain(tx); err != nil {
+			return err
+		}
+
+		var last AuditRecord
+		result := tx.Order("id desc").Limit(1).Find(&last)
+		if result.Error != nil || result.RowsAffected == 0 || last.Kind == audit.KindHead {
+			return result.Error
+		}
+
+		signed := audit.SignHead(last.toAudit(), key)
+		data, err := json.Marshal(signed)
+		if err != nil {
+			return err
+		}
+
+		head = &signed
+		return appendAuditRecords(tx, audit.KindHead, []string{string(data)})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return head, nil
+}
+
+// GetAuditRecords returns records of the chain in order, starting from the given ID.
+func (r Repo) GetAuditRecords(fromID uint64, limit int) ([]audit.Record, error) {
+	var rows []AuditRecord
+
+	db := r.db.Model(&AuditRecord{}).Where("id >= ?", fromID).Order("id")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	if result := db.Find(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+
+	records := make([]audit.Record, len(rows))
+	for i := range rows {
+		records[i] = rows[i].toAudit()
+	}
+
+	return records, nil
+}
+
+// VerifyAudit walks the whole stored chain and returns the number of records verified
+// before the chain was found broken. Heads are verified with the key unless it is nil.
+func (r Repo) VerifyAudit(key ed25519.PublicKey) (int, error) {
+	return verifyAudit(r.GetAuditRecords, key)
+}
+
+func verifyAudit(getAuditRecords func(fromID uint64, limit int) ([]audit.Record, error), key ed25519.PublicKey) (int, error) {
+	const batchSize = 1000
+
+	verified := 0
+	var fromID uint64
+	var head, prev *audit.Record
+	var checkpoint AuditCheckpoint
+
+	for {
+		records, err := getAuditRecords(fromID, batchSize)
+		if err != nil {
+			return verified, err
+		}
+
+		if len(records) == 0 {
+			break
+		}
+
+		for i := range records {
+			if err := audit.VerifyNext(prev, records[i]); err != nil {
+				return verified, err
+			}
+
+			if records[i].Kind == audit.KindCheckpoint {
+				if err := json.Unmarshal([]byte(records[i].Data), &checkpoint); err != nil {
+					return verified, fmt.Errorf("%w: checkpoint %d: %s", audit.ErrBrokenChain, records[i].ID, err)
+				}
+			}
+
+			if records[i].Kind == audit.KindHead && key != nil {
+				if err := verifyHead(records[i], key); err != nil {
+					return verified, err
+				}
+			}
+
+			if head == nil {
+				head = &records[i]
+			}
+
+			verified++
+			prev = &records[i]
+		}
+
+		fromID = prev.ID + 1
+	}
+
+	// the chain starts either from scratch or where the records removed by retention ended
+	if head != nil && head.PrevHash != "" && head.PrevHash != checkpoint.Hash {
+		return 0, fmt.Errorf("%w: record %d follows a removed record which is not the last checkpoint", audit.ErrBrokenChain, head.ID)
+	}
+
+	return verified, nil
+}
+
+func verifyHead(record audit.Record, key ed25519.PublicKey) error {
+	var head audit.Head
+	if err := json.Unmarshal([]byte(record.Data), &head); err != nil {
+		return fmt.Errorf("%w: head %d: %s", audit.ErrBrokenChain, record.ID, err)
+	}
+
+	if err := head.Verify(record.PrevHash, key); err != nil {
+		return fmt.Errorf("%w: head %d: %s", audit.ErrBrokenChain, record.ID, err)
+	}
+
+	return nil
+}
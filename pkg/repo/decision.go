@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/audit"
+	"gorm.io/gorm"
+)
+
+const (
+	VerdictAllowed   = "allowed"
+	VerdictDenied    = "denied"
+	VerdictMutated   = "mutated"
+	VerdictUnchanged = "unchanged"
+	VerdictExcluded  = "excluded"
+	VerdictBypassed  = "bypassed"
+)
+
+const (
+	ModeWebhookValidate = "webhook-validate"
+	ModeWebhookMutate   = "webhook-mutate"
+	ModeImagePolicy     = "image-policy"
+	ModeGRPCValidate    = "grpc-validate"
+	ModeGRPCMutate      = "grpc-mutate"
+	ModeGRPCEvaluate    = "grpc-evaluate"
+)
+
+// Decision is a single validation or mutation verdict made for an image.
+type Decision struct {
+	ID        uint      `gorm:"primarykey"`
+	Timestamp time.Time `gorm:"index"`
+	Namespace string    `gorm:"index"`
+	Object    string
+	Owner     string
+	Container string
+	Image     string `gorm:"index"`
+	Verdict   string `gorm:"index"`
+	Rule      string
+	Reason    string
+	Mode      string
+	// ShadowVerdict and ShadowRule are set when the shadow rules validated the image as well.
+	ShadowVerdict string
+	ShadowRule    string
+}
+
+type DecisionFilter struct {
+	Namespace string
+	Image     string
+	Verdict   string
+	Mode      string
+	Since     time.Time
+	Limit     int
+	// ShadowDiff selects only decisions which verdict of the shadow rules differs.
+	// A bypassed decision was denied by the rules, so it is compared as denied.
+	ShadowDiff bool
+}
+
+// ruleVerdict returns the verdict of the rules before a break-glass bypass.
+func (d Decision) ruleVerdict() string {
+	if d.Verdict == VerdictBypassed {
+		return VerdictDenied
+	}
+	return d.Verdict
+}
+
+func (r Repo) StoreDecisions(decisions []Decision) error {
+	if len(decisions) == 0 {
+		return nil
+	}
+
+	rows := decisionRows(decisions)
+
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockAuditChain(tx); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&rows).Error; err != nil {
+			return err
+		}
+
+		data, err := decisionsAuditData(rows)
+		if err != nil {
+			return err
+		}
+
+		return appendAuditRecords(tx, audit.KindDecision, data)
+	})
+}
+
+// decisionRows copies the decisions, the ones without timestamp are made now.
+func decisionRows(decisions []Decision) []Decision {
+	rows := make([]Decision, len(decisions))
+	for i := range decisions {
+		rows[i] = decisions[i]
+		if rows[i].Timestamp.IsZero() {
+			rows[i].Timestamp = time.Now().UTC()
+		}
+	}
+
+	return rows
+}
+
+// GetDecisions returns decisions matching the filter, the newest first.
+// Image is matched as a substring, other fields have to be equal.
+func (r Repo) GetDecisions(filter DecisionFilter) ([]Decision, error) {
+	var decisions []Decision
+
+	db := r.db.Model(&Decision{}).Order("timestamp desc, id desc")
+	if filter.Namespace != "" {
+		db = db.Where("namespace = ?", filter.Namespace)
+	}
+	if filter.Image != "" {
+		db = db.Where("image LIKE ?", "%"+filter.Image+"%")
+	}
+	if filter.Verdict != "" {
+		db = db.Where("verdict = ?", filter.Verdict)
+	}
+	if filter.Mode != "" {
+		db = db.Where("mode = ?", filter.Mode)
+	}
+	if filter.ShadowDiff {
+		db = db.Where("shadow_verdict != '' AND shadow_verdict != CASE WHEN verdict = ? THEN ? ELSE verdict END",
+			VerdictBypassed, VerdictDenied)
+	}
+	if !filter.Since.IsZero() {
+		db = db.Where("timestamp >= ?", filter.Since.UTC())
+	}
+	if filter.Limit > 0 {
+		db = db.Limit(filter.Limit)
+	}
+
+	if result := db.Find(&decisions); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return decisions, nil
+}
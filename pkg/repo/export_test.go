@@ -1,6 +1,25 @@
 package repo
 
-import "time"
+import (
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/audit"
+	"golang.org/x/exp/slices"
+
+	"gorm.io/gorm"
+)
+
+// TestStore is implemented by stores of every backend, so the same tests run against them.
+type TestStore interface {
+	Store
+	SetReportInterval(interval uint16)
+	SetRetention(retentionInSecs uint16)
+	SetDecisionRetention(retentionInSecs uint16)
+	CleanStaleRecords(d time.Duration) error
+	UpdateAuditRecordData(id uint64, data string) error
+	UpdateAuditRecord(record audit.Record) error
+	DeleteAuditRecord(id uint64) error
+}
 
 func (r *Repo) SetReportInterval(interval uint16) {
 	r.opts.ReportInterval = time.Duration(interval) * time.Second
@@ -10,6 +29,113 @@ func (r *Repo) SetRetention(retentionInSecs uint16) {
 	r.opts.Retention = time.Duration(retentionInSecs) * time.Second
 }
 
+func (r *Repo) SetDecisionRetention(retentionInSecs uint16) {
+	r.opts.DecisionRetention = time.Duration(retentionInSecs) * time.Second
+}
+
 func (r *Repo) CleanStaleRecords(d time.Duration) error {
 	return r.cleanStaleRecords(d)
 }
+
+func (r *Repo) UpdateAuditRecordData(id uint64, data string) error {
+	return r.db.Model(&AuditRecord{}).Where("id = ?", id).Update("data", data).Error
+}
+
+func (r *Repo) UpdateAuditRecord(record audit.Record) error {
+	return r.db.Save(AuditRecord(record)).Error
+}
+
+func (r *Repo) DeleteAuditRecord(id uint64) error {
+	return r.db.Delete(&AuditRecord{}, "id = ?", id).Error
+}
+
+func (r *MemoryRepo) SetReportInterval(interval uint16) {
+	r.opts.ReportInterval = time.Duration(interval) * time.Second
+}
+
+func (r *MemoryRepo) SetRetention(retentionInSecs uint16) {
+	r.opts.Retention = time.Duration(retentionInSecs) * time.Second
+}
+
+func (r *MemoryRepo) SetDecisionRetention(retentionInSecs uint16) {
+	r.opts.DecisionRetention = time.Duration(retentionInSecs) * time.Second
+}
+
+func (r *MemoryRepo) CleanStaleRecords(d time.Duration) error {
+	return r.cleanStaleRecords(d)
+}
+
+func (r *MemoryRepo) UpdateAuditRecordData(id uint64, data string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.data.auditRecords {
+		if r.data.auditRecords[i].ID == id {
+			r.data.auditRecords[i].Data = data
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRepo) UpdateAuditRecord(record audit.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.data.auditRecords {
+		if r.data.auditRecords[i].ID == record.ID {
+			r.data.auditRecords[i] = AuditRecord(record)
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRepo) DeleteAuditRecord(id uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.data.auditRecords = slices.DeleteFunc(r.data.auditRecords, func(record AuditRecord) bool {
+		return record.ID == id
+	})
+
+	return nil
+}
+
+// CreateUnversionedSchema creates tables the way stores were created before migrations were versioned.
+func CreateUnversionedSchema(dsn string) error {
+	return withDB(dsn, func(db *gorm.DB) error {
+		return db.AutoMigrate(&Node{}, &ImageReport{}, &ImageFilesystemReport{}, &Decision{}, &AuditRecord{}, &HealthCheck{})
+	})
+}
+
+// StoreSchemaMigration records a migration as if it was applied by a newer controller.
+func StoreSchemaMigration(dsn string, version uint) error {
+	return withDB(dsn, func(db *gorm.DB) error {
+		return db.Create(&SchemaMigration{Version: version, Name: "from the future", AppliedAt: time.Now().UTC()}).Error
+	})
+}
+
+func HasTable(dsn string, table string) (bool, error) {
+	var has bool
+	err := withDB(dsn, func(db *gorm.DB) error {
+		has = db.Migrator().HasTable(table)
+		return nil
+	})
+	return has, err
+}
+
+func withDB(dsn string, f func(db *gorm.DB) error) error {
+	db, err := gorm.Open(dialector(dsn), newGormConfig(false))
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	return f(db)
+}
@@ -0,0 +1,14 @@
+package repo
+
+import "time"
+
+// HealthCheck is a single row rewritten by CheckWritable.
+type HealthCheck struct {
+	ID        uint `gorm:"primarykey"`
+	CheckedAt time.Time
+}
+
+// CheckWritable makes sure the store accepts writes, e.g. the disk is not full or read-only.
+func (r Repo) CheckWritable() error {
+	return r.db.Save(&HealthCheck{ID: 1, CheckedAt: time.Now().UTC()}).Error
+}
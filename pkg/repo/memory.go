@@ -0,0 +1,446 @@
+package repo
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/audit"
+	"golang.org/x/exp/slices"
+)
+
+// MemoryDSN selects MemoryRepo in NewStore. Nothing is kept over restarts of the controller,
+// the audit trail included, so it suits tests and small clusters without a persistent volume.
+const MemoryDSN = "memory://"
+
+// NewStore opens the store of the DSN, MemoryDSN is kept in memory and other DSNs are opened by NewRepo.
+func NewStore(dsn string, reportIntervalSecs, retentionDays, decisionRetentionDays uint16) (Store, error) {
+	if dsn == MemoryDSN {
+		return NewMemoryRepo(reportIntervalSecs, retentionDays, decisionRetentionDays), nil
+	}
+
+	repo, err := NewRepo(dsn, reportIntervalSecs, retentionDays, decisionRetentionDays)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// MemoryRepo is the Store kept in memory, it behaves the same way as Repo does.
+type MemoryRepo struct {
+	mu     *sync.RWMutex
+	data   *memoryData
+	doneCh chan bool
+	opts   RepoOpts
+}
+
+// memoryData holds rows of every table in the order they were created, as SQLite returns them.
+type memoryData struct {
+	nodes          []Node
+	images         []ImageReport
+	filesystems    []ImageFilesystemReport
+	decisions      []Decision
+	auditRecords   []AuditRecord
+	lastNodeID     uint
+	lastDecisionID uint
+	lastAuditID    uint64
+}
+
+var _ Store = MemoryRepo{}
+
+func NewMemoryRepo(reportIntervalSecs, retentionDays, decisionRetentionDays uint16) *MemoryRepo {
+	return &MemoryRepo{
+		mu:     &sync.RWMutex{},
+		data:   &memoryData{},
+		doneCh: make(chan bool),
+		opts:   newRepoOpts(reportIntervalSecs, retentionDays, decisionRetentionDays),
+	}
+}
+
+func (r MemoryRepo) RunStaleRecordsCleaner() {
+	runStaleRecordsCleaner(r.opts, r.doneCh, r.cleanStaleRecords)
+}
+
+func (r MemoryRepo) StopStaleRecordsCleaner() {
+	stopStaleRecordsCleaner(r.opts, r.doneCh)
+}
+
+func (r MemoryRepo) cleanStaleRecords(nodesRetention time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.opts.DecisionRetention > 0 {
+		before := time.Now().Add(-r.opts.DecisionRetention).UTC()
+		r.data.decisions = slices.DeleteFunc(r.data.decisions, func(d Decision) bool {
+			return !d.Timestamp.After(before)
+		})
+		r.pruneAuditRecords(before)
+	}
+
+	if r.opts.Retention == 0 {
+		return nil
+	}
+
+	lastSeen := time.Now().Add(nodesRetention).UTC()
+	r.data.nodes = slices.DeleteFunc(r.data.nodes, func(n Node) bool {
+		return !n.LastSeen.After(lastSeen)
+	})
+
+	reportedAt := time.Now().Add(-r.opts.Retention).UTC()
+	r.data.images = slices.DeleteFunc(r.data.images, func(image ImageReport) bool {
+		return !image.ReportedAt.After(reportedAt)
+	})
+	r.data.filesystems = slices.DeleteFunc(r.data.filesystems, func(fs ImageFilesystemReport) bool {
+		return !fs.ReportedAt.After(reportedAt)
+	})
+
+	return nil
+}
+
+func (r MemoryRepo) GetReportForNode(node string, all bool) ([]Node, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	lastSeen := time.Now().Add(-3 * r.opts.ReportInterval).UTC()
+
+	report := []Node{}
+	for _, n := range r.data.nodes {
+		if node != "" && n.Nodename != node {
+			continue
+		}
+		if !all && n.LastSeen.Before(lastSeen) {
+			continue
+		}
+
+		n.Images = []ImageReport{}
+		for _, image := range r.data.images {
+			if image.NodeID == n.ID && (all || image.SeenInLastReport) {
+				n.Images = append(n.Images, image)
+			}
+		}
+
+		n.ImageFilesystems = []ImageFilesystemReport{}
+		for _, fs := range r.data.filesystems {
+			if fs.NodeID == n.ID && (all || fs.SeenInLastReport) {
+				n.ImageFilesystems = append(n.ImageFilesystems, fs)
+			}
+		}
+
+		report = append(report, n)
+	}
+
+	return report, nil
+}
+
+func (r MemoryRepo) StoreReport(node *Node, fsUsage []ImageFilesystemReport, images []ImageReport) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := slices.IndexFunc(r.data.nodes, node.matches)
+	if i < 0 {
+		r.data.lastNodeID++
+		node.ID = r.data.lastNodeID
+
+		stored := *node
+		stored.Images, stored.ImageFilesystems = nil, nil
+		r.data.nodes = append(r.data.nodes, stored)
+		i = len(r.data.nodes) - 1
+	} else {
+		node.ID = r.data.nodes[i].ID
+		node.LastSeen = r.data.nodes[i].LastSeen
+	}
+
+	now := time.Now().UTC()
+	r.data.nodes[i].LastSeen = now
+
+	for n := range r.data.filesystems {
+		if r.data.filesystems[n].NodeID == node.ID {
+			r.data.filesystems[n].SeenInLastReport = false
+		}
+	}
+
+	for n := range r.data.images {
+		if r.data.images[n].NodeID == node.ID {
+			r.data.images[n].SeenInLastReport = false
+		}
+	}
+
+	for _, fs := range fsUsage {
+		fs.NodeID = node.ID
+		fs.SeenInLastReport = true
+		fs.ReportedAt = now
+
+		n := slices.IndexFunc(r.data.filesystems, func(stored ImageFilesystemReport) bool {
+			return stored.Mountpoint == fs.Mountpoint && stored.NodeID == fs.NodeID
+		})
+		if n < 0 {
+			r.data.filesystems = append(r.data.filesystems, fs)
+		} else {
+			r.data.filesystems[n] = fs
+		}
+	}
+
+	for _, image := range images {
+		image.NodeID = node.ID
+		image.SeenInLastReport = true
+		image.ReportedAt = now
+
+		n := slices.IndexFunc(r.data.images, func(stored ImageReport) bool {
+			return stored.ID == image.ID && stored.RepoTag == image.RepoTag &&
+				stored.RepoDigest == image.RepoDigest && stored.NodeID == image.NodeID
+		})
+		if n < 0 {
+			r.data.images = append(r.data.images, image)
+		} else {
+			r.data.images[n] = image
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether the stored node has all non-zero fields of n, the same way as
+// the query of the struct in Repo.StoreReport does.
+func (n Node) matches(stored Node) bool {
+	return (n.ID == 0 || n.ID == stored.ID) &&
+		(n.Podname == "" || n.Podname == stored.Podname) &&
+		(n.Nodename == "" || n.Nodename == stored.Nodename) &&
+		(n.LastSeen.IsZero() || n.LastSeen.Equal(stored.LastSeen)) &&
+		(n.AgentVersion == "" || n.AgentVersion == stored.AgentVersion) &&
+		(n.KubeAPIVersion == "" || n.KubeAPIVersion == stored.KubeAPIVersion) &&
+		(n.RuntimeName == "" || n.RuntimeName == stored.RuntimeName) &&
+		(n.RuntimeVersion == "" || n.RuntimeVersion == stored.RuntimeVersion) &&
+		(n.RuntimeAPIVersion == "" || n.RuntimeAPIVersion == stored.RuntimeAPIVersion)
+}
+
+func (r MemoryRepo) GetDigestsByNameAndAfter(name string, after time.Time) ([]string, error) {
+	return r.distinctImageReports(name, after, func(image ImageReport) string { return image.RepoDigest }), nil
+}
+
+func (r MemoryRepo) GetIDsByNameAndAfter(name string, after time.Time) ([]string, error) {
+	return r.distinctImageReports(name, after, func(image ImageReport) string { return image.ID }), nil
+}
+
+func (r MemoryRepo) distinctImageReports(name string, after time.Time, column func(ImageReport) string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var values []string
+	for _, image := range r.data.images {
+		if image.RepoTag == name && image.ReportedAt.After(after) && !slices.Contains(values, column(image)) {
+			values = append(values, column(image))
+		}
+	}
+
+	return values
+}
+
+func (r MemoryRepo) StoreDecisions(decisions []Decision) error {
+	if len(decisions) == 0 {
+		return nil
+	}
+
+	rows := decisionRows(decisions)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range rows {
+		r.data.lastDecisionID++
+		rows[i].ID = r.data.lastDecisionID
+	}
+
+	data, err := decisionsAuditData(rows)
+	if err != nil {
+		return err
+	}
+
+	r.data.decisions = append(r.data.decisions, rows...)
+	r.appendAuditRecords(audit.KindDecision, data)
+
+	return nil
+}
+
+// GetDecisions returns decisions matching the filter, the newest first. Image is matched
+// as a case-insensitive substring like SQLite LIKE does, other fields have to be equal.
+func (r MemoryRepo) GetDecisions(filter DecisionFilter) ([]Decision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	image := strings.ToLower(filter.Image)
+
+	decisions := []Decision{}
+	for _, d := range r.data.decisions {
+		if filter.Namespace != "" && d.Namespace != filter.Namespace {
+			continue
+		}
+		if image != "" && !strings.Contains(strings.ToLower(d.Image), image) {
+			continue
+		}
+		if filter.Verdict != "" && d.Verdict != filter.Verdict {
+			continue
+		}
+		if filter.Mode != "" && d.Mode != filter.Mode {
+			continue
+		}
+		if filter.ShadowDiff && (d.ShadowVerdict == "" || d.ShadowVerdict == d.ruleVerdict()) {
+			continue
+		}
+		if !filter.Since.IsZero() && d.Timestamp.Before(filter.Since) {
+			continue
+		}
+
+		decisions = append(decisions, d)
+	}
+
+	slices.SortFunc(decisions, func(a, b Decision) int {
+		switch {
+		case a.Timestamp.After(b.Timestamp):
+			return -1
+		case a.Timestamp.Before(b.Timestamp):
+			return 1
+		default:
+			return int(b.ID) - int(a.ID)
+		}
+	})
+
+	if filter.Limit > 0 && len(decisions) > filter.Limit {
+		decisions = decisions[:filter.Limit]
+	}
+
+	return decisions, nil
+}
+
+// appendAuditRecords chains the records to the last stored one, it must be called with mu held.
+func (r MemoryRepo) appendAuditRecords(kind string, data []string) {
+	var prevHash string
+	if n := len(r.data.auditRecords); n > 0 {
+		prevHash = r.data.auditRecords[n-1].Hash
+	}
+
+	for _, record := range chainAuditRecords(prevHash, kind, data) {
+		r.data.lastAuditID++
+		record.ID = r.data.lastAuditID
+		r.data.auditRecords = append(r.data.auditRecords, record)
+	}
+}
+
+// pruneAuditRecords removes records the same way Repo does, it must be called with mu held.
+func (r MemoryRepo) pruneAuditRecords(before time.Time) {
+	records := r.data.auditRecords
+
+	last := -1
+	for i := range records {
+		if records[i].Timestamp <= before.UnixNano() {
+			last = i
+		}
+	}
+
+	// the chain starts with the checkpoint of the previous removal and heads signing it, there is nothing else to remove
+	if last < 0 || !slices.ContainsFunc(records[:last+1], func(record AuditRecord) bool {
+		return record.Kind != audit.KindCheckpoint && record.Kind != audit.KindHead
+	}) {
+		return
+	}
+
+	r.appendAuditRecords(audit.KindCheckpoint, []string{checkpointData(records[last])})
+	r.data.auditRecords = slices.Delete(r.data.auditRecords, 0, last+1)
+}
+
+// StoreRulesChange records the rules into the audit chain unless they are the same as the last recorded ones.
+func (r MemoryRepo) StoreRulesChange(source string, rules []byte) (bool, error) {
+	change := newRulesChange(source, rules)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.data.auditRecords) - 1; i >= 0; i-- {
+		if r.data.auditRecords[i].Kind != audit.KindRules {
+			continue
+		}
+		if change.sameAs(r.data.auditRecords[i]) {
+			return false, nil
+		}
+		break
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return false, err
+	}
+
+	r.appendAuditRecords(audit.KindRules, []string{string(data)})
+
+	return true, nil
+}
+
+// GetAuditRecords returns records of the chain in order, starting from the given ID.
+func (r MemoryRepo) GetAuditRecords(fromID uint64, limit int) ([]audit.Record, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	records := []audit.Record{}
+	for _, record := range r.data.auditRecords {
+		if limit > 0 && len(records) == limit {
+			break
+		}
+		if record.ID >= fromID {
+			records = append(records, record.toAudit())
+		}
+	}
+
+	return records, nil
+}
+
+// SignAuditHead appends a head signing the last record, unless the chain is empty or already ends with a head.
+func (r MemoryRepo) SignAuditHead(key ed25519.PrivateKey) (*audit.Head, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.data.auditRecords)
+	if n == 0 || r.data.auditRecords[n-1].Kind == audit.KindHead {
+		return nil, nil
+	}
+
+	head := audit.SignHead(r.data.auditRecords[n-1].toAudit(), key)
+	data, err := json.Marshal(head)
+	if err != nil {
+		return nil, err
+	}
+
+	r.appendAuditRecords(audit.KindHead, []string{string(data)})
+
+	return &head, nil
+}
+
+// VerifyAudit walks the whole stored chain and returns the number of records verified
+// before the chain was found broken. Heads are verified with the key unless it is nil.
+func (r MemoryRepo) VerifyAudit(key ed25519.PublicKey) (int, error) {
+	return verifyAudit(r.GetAuditRecords, key)
+}
+
+// CountRecords returns number of rows by table.
+func (r MemoryRepo) CountRecords() (map[string]int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return map[string]int64{
+		"nodes":                    int64(len(r.data.nodes)),
+		"image_reports":            int64(len(r.data.images)),
+		"image_filesystem_reports": int64(len(r.data.filesystems)),
+		"decisions":                int64(len(r.data.decisions)),
+		"audit_records":            int64(len(r.data.auditRecords)),
+	}, nil
+}
+
+// CheckWritable always succeeds, memory is never read-only.
+func (r MemoryRepo) CheckWritable() error {
+	return nil
+}
+
+func (r MemoryRepo) Close() error {
+	return nil
+}
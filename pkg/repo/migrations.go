@@ -0,0 +1,233 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNewerSchema = errors.New("schema of the store is newer than supported")
+	ErrNoSchema    = errors.New("store has no schema")
+)
+
+// schemaLockID is the PostgreSQL advisory lock taken by replicas migrating the same database.
+const schemaLockID = 0x6b6978
+
+// SchemaMigration is a row of the schema table, one per applied migration.
+type SchemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// migration changes the schema from the previous version to its version, down reverts it.
+// Migrations never use models of the package, as the models follow the latest version.
+type migration struct {
+	version uint
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// migrations are ordered by version, a new migration is only ever appended.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// stores created before migrations were versioned get the missing tables and columns only
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(schemaV1...)
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(schemaV1...)
+		},
+	},
+	{
+		version: 2,
+		name:    "index image reports by tag",
+		up: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE INDEX idx_image_reports_repo_tag_reported_at ON image_reports (repo_tag, reported_at)").Error
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP INDEX idx_image_reports_repo_tag_reported_at").Error
+		},
+	},
+}
+
+// SchemaVersion is the latest version of the schema the store is migrated to on start.
+func SchemaVersion() uint {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrateStore migrates the store of the DSN up or down to the version and returns the version it had.
+func MigrateStore(dsn string, version uint) (uint, error) {
+	if dsn == MemoryDSN {
+		return 0, fmt.Errorf("%w: it is kept in memory", ErrNoSchema)
+	}
+
+	if version > SchemaVersion() {
+		return 0, fmt.Errorf("%w: version %d is unknown, %d is the latest", ErrNewerSchema, version, SchemaVersion())
+	}
+
+	// statements are not prepared, as they would outlive tables dropped by down-migrations
+	db, err := gorm.Open(dialector(dsn), newGormConfig(false))
+	if err != nil {
+		return 0, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlDB.Close()
+
+	return migrate(db, version)
+}
+
+// migrate applies migrations within a single transaction, so a failed migration leaves the schema as it was.
+func migrate(db *gorm.DB, version uint) (uint, error) {
+	var current uint
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if tx.Dialector.Name() == "postgres" {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", schemaLockID).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.AutoMigrate(&SchemaMigration{}); err != nil {
+			return err
+		}
+
+		result := tx.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&current)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if current > SchemaVersion() {
+			return fmt.Errorf("%w: the store has version %d, %d is the latest known", ErrNewerSchema, current, SchemaVersion())
+		}
+
+		for _, m := range migrations {
+			if m.version <= current || m.version > version {
+				continue
+			}
+
+			if err := m.up(tx); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+
+			err := tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now().UTC()}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if m.version > current || m.version <= version {
+				continue
+			}
+
+			if err := m.down(tx); err != nil {
+				return fmt.Errorf("migration %d (%s) down: %w", m.version, m.name, err)
+			}
+
+			if err := tx.Delete(&SchemaMigration{}, "version = ?", m.version).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return current, err
+}
+
+// schemaV1 are tables of the initial schema, as they were created by AutoMigrate of the models.
+var schemaV1 = []interface{}{
+	&nodeV1{}, &imageReportV1{}, &imageFilesystemReportV1{}, &decisionV1{}, &auditRecordV1{}, &healthCheckV1{},
+}
+
+type nodeV1 struct {
+	ID                uint   `gorm:"primarykey"`
+	Podname           string `gorm:"index"`
+	Nodename          string `gorm:"index"`
+	LastSeen          time.Time
+	AgentVersion      string
+	KubeAPIVersion    string
+	RuntimeName       string
+	RuntimeVersion    string
+	RuntimeAPIVersion string
+}
+
+func (nodeV1) TableName() string { return "nodes" }
+
+type imageReportV1 struct {
+	ID                 string `gorm:"primaryKey"`
+	RepoTag            string `gorm:"primaryKey"`
+	RepoDigest         string `gorm:"primaryKey"`
+	NodeID             uint   `gorm:"primaryKey"`
+	Size               uint64
+	Username           string
+	Image              string
+	Annotations        map[string]string `gorm:"serializer:json"`
+	UserSpecifiedImage string
+	Pinned             bool
+	UID                int64
+	ReportedAt         time.Time
+	SeenInLastReport   bool
+}
+
+func (imageReportV1) TableName() string { return "image_reports" }
+
+type imageFilesystemReportV1 struct {
+	Timestamp        time.Time
+	Mountpoint       string `gorm:"primaryKey"`
+	NodeID           uint   `gorm:"primaryKey"`
+	UsedBytes        uint64
+	InodesUsed       uint64
+	ReportedAt       time.Time
+	SeenInLastReport bool
+}
+
+func (imageFilesystemReportV1) TableName() string { return "image_filesystem_reports" }
+
+type decisionV1 struct {
+	ID            uint      `gorm:"primarykey"`
+	Timestamp     time.Time `gorm:"index"`
+	Namespace     string    `gorm:"index"`
+	Object        string
+	Owner         string
+	Container     string
+	Image         string `gorm:"index"`
+	Verdict       string `gorm:"index"`
+	Rule          string
+	Reason        string
+	Mode          string
+	ShadowVerdict string
+	ShadowRule    string
+}
+
+func (decisionV1) TableName() string { return "decisions" }
+
+type auditRecordV1 struct {
+	ID        uint64 `gorm:"primarykey"`
+	Timestamp int64  `gorm:"index"`
+	Kind      string `gorm:"index"`
+	Data      string
+	PrevHash  string
+	Hash      string
+}
+
+func (auditRecordV1) TableName() string { return "audit_records" }
+
+type healthCheckV1 struct {
+	ID        uint `gorm:"primarykey"`
+	CheckedAt time.Time
+}
+
+func (healthCheckV1) TableName() string { return "health_checks" }
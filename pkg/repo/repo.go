@@ -2,8 +2,11 @@ package repo
 
 import (
 	"log"
+	"strings"
+	"sync"
 	"time"
 
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -50,60 +53,112 @@ type ImageFilesystemReport struct {
 	SeenInLastReport bool
 }
 
+// recordTables are counted by CountRecords.
+var recordTables = []string{"nodes", "image_reports", "image_filesystem_reports", "decisions", "audit_records"}
+
 type RepoOpts struct {
-	ReportInterval  time.Duration
-	Retention       time.Duration
-	NodeRetention   time.Duration
-	CleanerInterval time.Duration
+	ReportInterval    time.Duration
+	Retention         time.Duration
+	DecisionRetention time.Duration
+	NodeRetention     time.Duration
+	CleanerInterval   time.Duration
 }
 
 type Repo struct {
-	db     *gorm.DB
-	doneCh chan bool
-	opts   RepoOpts
+	db      *gorm.DB
+	doneCh  chan bool
+	opts    RepoOpts
+	auditMu *sync.Mutex
 }
 
-func NewRepo(file string, reportIntervalSecs, retentionDays uint16) (*Repo, error) {
-	config := gorm.Config{
-		PrepareStmt:            true,
-		SkipDefaultTransaction: true,
-		Logger:                 logger.Default.LogMode(logger.Silent),
-	}
-
-	db, err := gorm.Open(sqlite.Open(file), &config)
+// NewRepo opens the store of the DSN, postgres:// and postgresql:// URLs are PostgreSQL databases,
+// anything else is a SQLite file. Replicas of the controller can share a PostgreSQL database.
+// The schema is migrated to SchemaVersion, stores of a newer schema are refused with ErrNewerSchema.
+func NewRepo(dsn string, reportIntervalSecs, retentionDays, decisionRetentionDays uint16) (*Repo, error) {
+	db, err := gorm.Open(dialector(dsn), newGormConfig(true))
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&Node{}, &ImageReport{}, &ImageFilesystemReport{})
+	version, err := migrate(db, SchemaVersion())
 	if err != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
 		return nil, err
 	}
 
+	if version < SchemaVersion() {
+		log.Printf("store schema is migrated from version %d to %d\n", version, SchemaVersion())
+	}
+
 	return &Repo{
-		db:     db,
-		doneCh: make(chan bool),
-		opts: RepoOpts{
-			ReportInterval:  time.Duration(reportIntervalSecs) * time.Second,
-			Retention:       time.Duration(retentionDays) * time.Hour,
-			NodeRetention:   time.Duration(24) * time.Hour,
-			CleanerInterval: time.Minute,
-		},
+		db:      db,
+		doneCh:  make(chan bool),
+		auditMu: &sync.Mutex{},
+		opts:    newRepoOpts(reportIntervalSecs, retentionDays, decisionRetentionDays),
 	}, nil
 }
 
+func newRepoOpts(reportIntervalSecs, retentionDays, decisionRetentionDays uint16) RepoOpts {
+	return RepoOpts{
+		ReportInterval:    time.Duration(reportIntervalSecs) * time.Second,
+		Retention:         time.Duration(retentionDays) * time.Hour,
+		DecisionRetention: time.Duration(decisionRetentionDays) * 24 * time.Hour,
+		NodeRetention:     time.Duration(24) * time.Hour,
+		CleanerInterval:   time.Minute,
+	}
+}
+
+func newGormConfig(prepareStmt bool) *gorm.Config {
+	return &gorm.Config{
+		PrepareStmt:            prepareStmt,
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+		// reports outlive nodes they belong to, see cleanStaleRecords, which SQLite doesn't enforce
+		DisableForeignKeyConstraintWhenMigrating: true,
+	}
+}
+
+func dialector(dsn string) gorm.Dialector {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgres.Open(dsn)
+	}
+
+	return sqlite.Open(dsn)
+}
+
+// Close closes connections of the store.
+func (r Repo) Close() error {
+	db, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return db.Close()
+}
+
 func (r Repo) RunStaleRecordsCleaner() {
-	if r.opts.Retention == 0 {
+	runStaleRecordsCleaner(r.opts, r.doneCh, r.cleanStaleRecords)
+}
+
+func (r Repo) StopStaleRecordsCleaner() {
+	stopStaleRecordsCleaner(r.opts, r.doneCh)
+}
+
+// runStaleRecordsCleaner cleans records of any store every CleanerInterval until it is stopped.
+func runStaleRecordsCleaner(opts RepoOpts, doneCh chan bool, clean func(nodesRetention time.Duration) error) {
+	if opts.Retention == 0 && opts.DecisionRetention == 0 {
 		return
 	}
 
 	go func() {
 		for {
 			select {
-			case <-r.doneCh:
+			case <-doneCh:
 				return
-			case <-time.After(r.opts.CleanerInterval):
-				err := r.cleanStaleRecords(-r.opts.NodeRetention)
+			case <-time.After(opts.CleanerInterval):
+				err := clean(-opts.NodeRetention)
 				if err != nil {
 					log.Printf("error when deleting stale records %s", err)
 				}
@@ -112,32 +167,53 @@ func (r Repo) RunStaleRecordsCleaner() {
 	}()
 }
 
-func (r Repo) StopStaleRecordsCleaner() {
-	if r.opts.Retention == 0 {
+func stopStaleRecordsCleaner(opts RepoOpts, doneCh chan bool) {
+	if opts.Retention == 0 && opts.DecisionRetention == 0 {
 		return
 	}
 
-	r.doneCh <- true
+	doneCh <- true
 	log.Println("Repo Stale Records Cleaner was shutdown")
 }
 
 func (r Repo) cleanStaleRecords(nodesRetention time.Duration) error {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
 	return r.db.Transaction(func(tx *gorm.DB) error {
+		// Decisions have their own retention and are kept independently of reports.
+		if r.opts.DecisionRetention > 0 {
+			before := time.Now().Add(-r.opts.DecisionRetention).UTC()
+			err := tx.Delete(&Decision{}, "timestamp <= ?", before).Error
+			if err != nil {
+				return err
+			}
+
+			err = pruneAuditRecords(tx, before)
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.opts.Retention == 0 {
+			return nil
+		}
+
 		// We delete nodes if non seen for given nodesRetention.
 		// Image and Filesystem reports are being deleted based on Retention configuration.
-		err := r.db.Delete(&Node{}, "last_seen <= ?", time.Now().Add(nodesRetention).UTC()).Error
+		err := tx.Delete(&Node{}, "last_seen <= ?", time.Now().Add(nodesRetention).UTC()).Error
 		if err != nil {
 			return err
 		}
 
 		reportedAt := time.Now().Add(-r.opts.Retention).UTC()
 
-		err = r.db.Delete(&ImageReport{}, "reported_at <= ?", reportedAt).Error
+		err = tx.Delete(&ImageReport{}, "reported_at <= ?", reportedAt).Error
 		if err != nil {
 			return err
 		}
 
-		err = r.db.Delete(&ImageFilesystemReport{}, "reported_at <= ?", reportedAt).Error
+		err = tx.Delete(&ImageFilesystemReport{}, "reported_at <= ?", reportedAt).Error
 		if err != nil {
 			return err
 		}
@@ -149,7 +225,7 @@ func (r Repo) cleanStaleRecords(nodesRetention time.Duration) error {
 func (r Repo) GetReportForNode(node string, all bool) ([]Node, error) {
 	var report []Node
 
-	db := r.db.Model(&Node{})
+	db := r.db.Model(&Node{}).Order("id")
 	if all {
 		db = db.Preload("Images").Preload("ImageFilesystems")
 	} else {
@@ -239,3 +315,17 @@ func (r Repo) GetIDsByNameAndAfter(name string, after time.Time) ([]string, erro
 
 	return ids, result.Error
 }
+
+// CountRecords returns number of rows by table.
+func (r Repo) CountRecords() (map[string]int64, error) {
+	counts := make(map[string]int64, len(recordTables))
+	for _, table := range recordTables {
+		var count int64
+		if result := r.db.Table(table).Count(&count); result.Error != nil {
+			return nil, result.Error
+		}
+		counts[table] = count
+	}
+
+	return counts, nil
+}
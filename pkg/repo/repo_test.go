@@ -1,58 +1,519 @@
 package repo_test
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/surik/k8s-image-warden/pkg/audit"
 	"github.com/surik/k8s-image-warden/pkg/controller"
+	"github.com/surik/k8s-image-warden/pkg/repo"
 	helpers "github.com/surik/k8s-image-warden/pkg/repo/testing"
 )
 
 func TestRepo(t *testing.T) {
-	repo := helpers.NewTestRepo(t)
-
-	node, fsUsage, images := controller.ConvertReportToRepo(helpers.Report1())
-	err := repo.StoreReport(node, fsUsage, images)
-	require.NoError(t, err)
-
-	node, fsUsage, images = controller.ConvertReportToRepo(helpers.Report2())
-	err = repo.StoreReport(node, fsUsage, images)
-	require.NoError(t, err)
-
-	// get report for all two nodes
-	report, err := repo.GetReportForNode("", true)
-	require.NoError(t, err)
-	require.Len(t, report, 2)
-	require.Equal(t, helpers.Node1, report[0].Nodename)
-	require.Equal(t, helpers.Node2, report[1].Nodename)
-	require.Len(t, report[0].Images, 1)
-	require.Equal(t, helpers.ImageSha1, report[0].Images[0].ID)
-	require.Len(t, report[1].Images, 1)
-	require.Equal(t, helpers.ImageSha2, report[1].Images[0].ID)
-
-	// get report for Node1
-	report, err = repo.GetReportForNode(helpers.Node2, true)
-	require.NoError(t, err)
-	require.Len(t, report, 1)
-	require.Equal(t, helpers.Node2, report[0].Nodename)
-	require.Len(t, report[0].Images, 1)
-	require.Equal(t, helpers.ImageSha2, report[0].Images[0].ID)
-	require.Len(t, report[0].ImageFilesystems, 1)
-	require.Equal(t, helpers.FsMountpoint2, report[0].ImageFilesystems[0].Mountpoint)
-
-	// get report for Node1 pretending that the node disappeared
-	repo.SetReportInterval(0)
-	report, err = repo.GetReportForNode(helpers.Node2, false)
-	require.NoError(t, err)
-	require.Len(t, report, 0)
-
-	// Test Clean Stale Records job
-	repo.SetRetention(1)
-	time.Sleep(1 * time.Second)
-	err = repo.CleanStaleRecords(0)
-	require.NoError(t, err)
-	report, err = repo.GetReportForNode("", true)
-	require.NoError(t, err)
-	require.Len(t, report, 0)
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		repo := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		node, fsUsage, images := controller.ConvertReportToRepo(helpers.Report1())
+		err := repo.StoreReport(node, fsUsage, images)
+		require.NoError(t, err)
+
+		node, fsUsage, images = controller.ConvertReportToRepo(helpers.Report2())
+		err = repo.StoreReport(node, fsUsage, images)
+		require.NoError(t, err)
+
+		// get report for all two nodes
+		report, err := repo.GetReportForNode("", true)
+		require.NoError(t, err)
+		require.Len(t, report, 2)
+		require.Equal(t, helpers.Node1, report[0].Nodename)
+		require.Equal(t, helpers.Node2, report[1].Nodename)
+		require.Len(t, report[0].Images, 1)
+		require.Equal(t, helpers.ImageSha1, report[0].Images[0].ID)
+		require.Len(t, report[1].Images, 1)
+		require.Equal(t, helpers.ImageSha2, report[1].Images[0].ID)
+
+		// get report for Node1
+		report, err = repo.GetReportForNode(helpers.Node2, true)
+		require.NoError(t, err)
+		require.Len(t, report, 1)
+		require.Equal(t, helpers.Node2, report[0].Nodename)
+		require.Len(t, report[0].Images, 1)
+		require.Equal(t, helpers.ImageSha2, report[0].Images[0].ID)
+		require.Len(t, report[0].ImageFilesystems, 1)
+		require.Equal(t, helpers.FsMountpoint2, report[0].ImageFilesystems[0].Mountpoint)
+
+		// get report for Node1 pretending that the node disappeared
+		repo.SetReportInterval(0)
+		report, err = repo.GetReportForNode(helpers.Node2, false)
+		require.NoError(t, err)
+		require.Len(t, report, 0)
+
+		// Test Clean Stale Records job
+		repo.SetRetention(1)
+		time.Sleep(1 * time.Second)
+		err = repo.CleanStaleRecords(0)
+		require.NoError(t, err)
+		report, err = repo.GetReportForNode("", true)
+		require.NoError(t, err)
+		require.Len(t, report, 0)
+	})
+}
+
+func TestRepo_Decisions(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		r := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		now := time.Now().UTC()
+		err := r.StoreDecisions([]repo.Decision{
+			{Timestamp: now.Add(-2 * time.Hour), Namespace: "default", Object: "Pod/nginx", Container: "nginx",
+				Image: "docker.io/nginx:1.25", Verdict: repo.VerdictAllowed, Mode: repo.ModeWebhookValidate,
+				ShadowVerdict: repo.VerdictDenied, ShadowRule: "no-nginx"},
+			{Timestamp: now.Add(-time.Hour), Namespace: "kube-system", Object: "Pod/proxy", Container: "proxy",
+				Image: "docker.io/proxy:latest", Verdict: repo.VerdictDenied, Rule: "no-latest", Mode: repo.ModeWebhookValidate,
+				ShadowVerdict: repo.VerdictDenied, ShadowRule: "no-latest"},
+			{Image: "docker.io/nginx", Verdict: repo.VerdictMutated, Rule: "default-tag", Mode: repo.ModeGRPCMutate},
+		})
+		require.NoError(t, err)
+
+		// the newest first
+		decisions, err := r.GetDecisions(repo.DecisionFilter{})
+		require.NoError(t, err)
+		require.Len(t, decisions, 3)
+		require.Equal(t, repo.VerdictMutated, decisions[0].Verdict)
+		require.False(t, decisions[0].Timestamp.IsZero())
+		require.Equal(t, repo.VerdictAllowed, decisions[2].Verdict)
+
+		decisions, err = r.GetDecisions(repo.DecisionFilter{Namespace: "kube-system"})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+		require.Equal(t, "no-latest", decisions[0].Rule)
+
+		decisions, err = r.GetDecisions(repo.DecisionFilter{Image: "nginx"})
+		require.NoError(t, err)
+		require.Len(t, decisions, 2)
+
+		decisions, err = r.GetDecisions(repo.DecisionFilter{Verdict: repo.VerdictDenied, Mode: repo.ModeWebhookValidate})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+
+		decisions, err = r.GetDecisions(repo.DecisionFilter{Since: now.Add(-90 * time.Minute)})
+		require.NoError(t, err)
+		require.Len(t, decisions, 2)
+
+		decisions, err = r.GetDecisions(repo.DecisionFilter{Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+
+		// only decisions which shadow verdict differs
+		decisions, err = r.GetDecisions(repo.DecisionFilter{ShadowDiff: true})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+		require.Equal(t, "no-nginx", decisions[0].ShadowRule)
+
+		// bypassed decisions were denied by the rules
+		err = r.StoreDecisions([]repo.Decision{
+			{Timestamp: now.Add(-3 * time.Hour), Namespace: "default", Object: "Pod/app", Container: "app",
+				Image: "docker.io/app:latest", Verdict: repo.VerdictBypassed, Rule: "no-latest", Mode: repo.ModeWebhookValidate,
+				ShadowVerdict: repo.VerdictDenied, ShadowRule: "no-latest"},
+			{Timestamp: now.Add(-3 * time.Hour), Namespace: "default", Object: "Pod/web", Container: "web",
+				Image: "docker.io/web:latest", Verdict: repo.VerdictBypassed, Rule: "no-latest", Mode: repo.ModeWebhookValidate,
+				ShadowVerdict: repo.VerdictAllowed},
+		})
+		require.NoError(t, err)
+		decisions, err = r.GetDecisions(repo.DecisionFilter{ShadowDiff: true})
+		require.NoError(t, err)
+		require.Len(t, decisions, 2)
+		require.Equal(t, "no-nginx", decisions[0].ShadowRule)
+		require.Equal(t, "Pod/web", decisions[1].Object)
+
+		// decisions older than retention are removed
+		r.SetRetention(0)
+		r.SetDecisionRetention(60 * 30)
+		err = r.CleanStaleRecords(0)
+		require.NoError(t, err)
+		decisions, err = r.GetDecisions(repo.DecisionFilter{})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+		require.Equal(t, repo.VerdictMutated, decisions[0].Verdict)
+	})
+}
+
+func TestRepo_Audit(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		r := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		stored, err := r.StoreRulesChange("rules.yaml", []byte("rules: []"))
+		require.NoError(t, err)
+		require.True(t, stored)
+
+		// the same rules are not recorded twice
+		stored, err = r.StoreRulesChange("rules.yaml", []byte("rules: []"))
+		require.NoError(t, err)
+		require.False(t, stored)
+
+		err = r.StoreDecisions([]repo.Decision{
+			{Image: "docker.io/nginx:1.25", Verdict: repo.VerdictAllowed, Mode: repo.ModeWebhookValidate},
+			{Image: "docker.io/nginx:latest", Verdict: repo.VerdictDenied, Mode: repo.ModeWebhookValidate},
+		})
+		require.NoError(t, err)
+
+		records, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		require.Equal(t, audit.KindRules, records[0].Kind)
+		require.Equal(t, audit.KindDecision, records[1].Kind)
+		require.Contains(t, records[2].Data, "docker.io/nginx:latest")
+		require.Equal(t, records[1].Hash, records[2].PrevHash)
+
+		verified, err := r.VerifyAudit(nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, verified)
+
+		counts, err := r.CountRecords()
+		require.NoError(t, err)
+		require.Equal(t, int64(2), counts["decisions"])
+		require.Equal(t, int64(3), counts["audit_records"])
+
+		// editing a record in the store is detected
+		err = r.UpdateAuditRecordData(records[2].ID, strings.Replace(records[2].Data, "denied", "allowed", 1))
+		require.NoError(t, err)
+
+		verified, err = r.VerifyAudit(nil)
+		require.ErrorIs(t, err, audit.ErrBrokenChain)
+		require.Equal(t, 2, verified)
+	})
+}
+
+func TestRepo_AuditRetention(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		r := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		_, err := r.StoreRulesChange("rules.yaml", []byte("rules: []"))
+		require.NoError(t, err)
+
+		err = r.StoreDecisions([]repo.Decision{{Image: "docker.io/nginx:1.25", Verdict: repo.VerdictAllowed}})
+		require.NoError(t, err)
+
+		removed, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Len(t, removed, 2)
+
+		// records older than retention are replaced by the checkpoint of the last removed one
+		r.SetRetention(0)
+		r.SetDecisionRetention(1)
+		time.Sleep(time.Second)
+		err = r.CleanStaleRecords(0)
+		require.NoError(t, err)
+
+		err = r.StoreDecisions([]repo.Decision{{Image: "docker.io/nginx:1.26", Verdict: repo.VerdictAllowed}})
+		require.NoError(t, err)
+
+		records, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		require.Equal(t, audit.KindCheckpoint, records[0].Kind)
+		require.Equal(t, removed[1].Hash, records[0].PrevHash)
+
+		var checkpoint repo.AuditCheckpoint
+		err = json.Unmarshal([]byte(records[0].Data), &checkpoint)
+		require.NoError(t, err)
+		require.Equal(t, repo.AuditCheckpoint{ID: removed[1].ID, Hash: removed[1].Hash}, checkpoint)
+
+		verified, err := r.VerifyAudit(nil)
+		require.NoError(t, err)
+		require.Equal(t, 2, verified)
+
+		time.Sleep(time.Second)
+		err = r.CleanStaleRecords(0)
+		require.NoError(t, err)
+
+		records, err = r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, audit.KindCheckpoint, records[0].Kind)
+
+		// the checkpoint alone is not replaced by another one
+		time.Sleep(time.Second)
+		err = r.CleanStaleRecords(0)
+		require.NoError(t, err)
+
+		verified, err = r.VerifyAudit(nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, verified)
+
+		kept, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Equal(t, records, kept)
+
+		// removing the head of the chain is detected
+		err = r.StoreDecisions([]repo.Decision{{Image: "docker.io/nginx:1.27", Verdict: repo.VerdictAllowed}})
+		require.NoError(t, err)
+		err = r.DeleteAuditRecord(records[0].ID)
+		require.NoError(t, err)
+
+		verified, err = r.VerifyAudit(nil)
+		require.ErrorIs(t, err, audit.ErrBrokenChain)
+		require.Equal(t, 0, verified)
+	})
+}
+
+func TestRepo_AuditHeads(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		r := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		// nothing to sign yet
+		head, err := r.SignAuditHead(privateKey)
+		require.NoError(t, err)
+		require.Nil(t, head)
+
+		_, err = r.StoreRulesChange("rules.yaml", []byte("rules: []"))
+		require.NoError(t, err)
+
+		err = r.StoreDecisions([]repo.Decision{{Image: "docker.io/nginx:latest", Verdict: repo.VerdictDenied}})
+		require.NoError(t, err)
+
+		records, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+
+		head, err = r.SignAuditHead(privateKey)
+		require.NoError(t, err)
+		require.Equal(t, records[1].ID, head.ID)
+		require.Equal(t, records[1].Hash, head.Hash)
+
+		// the head is not signed again
+		again, err := r.SignAuditHead(privateKey)
+		require.NoError(t, err)
+		require.Nil(t, again)
+
+		verified, err := r.VerifyAudit(publicKey)
+		require.NoError(t, err)
+		require.Equal(t, 3, verified)
+
+		otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		verified, err = r.VerifyAudit(otherKey)
+		require.ErrorIs(t, err, audit.ErrBrokenChain)
+		require.Equal(t, 2, verified)
+
+		// the chain rewritten with recomputed hashes is consistent, but the head doesn't sign it
+		records, err = r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		records[1].Data = strings.Replace(records[1].Data, "denied", "allowed", 1)
+		records[1].Hash = records[1].ComputeHash()
+		records[2].PrevHash = records[1].Hash
+		records[2].Hash = records[2].ComputeHash()
+		for _, record := range records[1:] {
+			err = r.UpdateAuditRecord(record)
+			require.NoError(t, err)
+		}
+
+		verified, err = r.VerifyAudit(nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, verified)
+
+		verified, err = r.VerifyAudit(publicKey)
+		require.ErrorIs(t, err, audit.ErrBrokenChain)
+		require.Equal(t, 2, verified)
+	})
+}
+
+func TestRepo_AuditHeadsRetention(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		r := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		err = r.StoreDecisions([]repo.Decision{{Image: "docker.io/nginx:1.25", Verdict: repo.VerdictAllowed}})
+		require.NoError(t, err)
+		_, err = r.SignAuditHead(privateKey)
+		require.NoError(t, err)
+
+		r.SetRetention(0)
+		r.SetDecisionRetention(1)
+		time.Sleep(time.Second)
+		err = r.CleanStaleRecords(0)
+		require.NoError(t, err)
+
+		// the checkpoint is signed as any other record
+		head, err := r.SignAuditHead(privateKey)
+		require.NoError(t, err)
+		require.NotNil(t, head)
+
+		records, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		require.Equal(t, audit.KindCheckpoint, records[0].Kind)
+		require.Equal(t, audit.KindHead, records[1].Kind)
+
+		// the checkpoint and its head are not replaced by another checkpoint
+		time.Sleep(time.Second)
+		err = r.CleanStaleRecords(0)
+		require.NoError(t, err)
+
+		kept, err := r.GetAuditRecords(0, 0)
+		require.NoError(t, err)
+		require.Equal(t, records, kept)
+
+		verified, err := r.VerifyAudit(publicKey)
+		require.NoError(t, err)
+		require.Equal(t, 2, verified)
+	})
+}
+
+func TestRepo_Reopen(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		if dsn == repo.MemoryDSN {
+			t.Skip("the store in memory is gone once it is closed")
+		}
+
+		r := helpers.OpenTestRepo(t, dsn)
+
+		stored, err := r.StoreRulesChange("rules.yaml", []byte("rules: []"))
+		require.NoError(t, err)
+		require.True(t, stored)
+
+		// migrations run again on the existing store, e.g. by another replica
+		r = helpers.OpenTestRepo(t, dsn)
+
+		stored, err = r.StoreRulesChange("rules.yaml", []byte("rules: []"))
+		require.NoError(t, err)
+		require.False(t, stored)
+
+		verified, err := r.VerifyAudit(nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, verified)
+	})
+}
+
+func TestRepo_SeenInLastReport(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		r := helpers.OpenTestRepo(t, dsn).(repo.TestStore)
+
+		node := repo.Node{Podname: "pod-agent-1", Nodename: helpers.Node1, AgentVersion: "1.0.0"}
+		nginx := repo.ImageReport{ID: helpers.ImageSha1, RepoTag: "docker.io/nginx:latest", RepoDigest: helpers.Digest1}
+		redis := repo.ImageReport{ID: helpers.ImageSha2, RepoTag: "docker.io/redis:latest", RepoDigest: helpers.Digest2}
+		fs := repo.ImageFilesystemReport{Mountpoint: helpers.FsMountpoint1, UsedBytes: 1000}
+
+		first := node
+		err := r.StoreReport(&first, []repo.ImageFilesystemReport{fs}, []repo.ImageReport{nginx, redis})
+		require.NoError(t, err)
+		require.NotZero(t, first.ID)
+
+		// the same node reports nginx of another digest and no redis
+		nginx.ID, nginx.RepoDigest = helpers.ImageSha3, helpers.Digest3
+		fs.UsedBytes = 2000
+		second := node
+		err = r.StoreReport(&second, []repo.ImageFilesystemReport{fs}, []repo.ImageReport{nginx})
+		require.NoError(t, err)
+		require.Equal(t, first.ID, second.ID)
+
+		report, err := r.GetReportForNode(helpers.Node1, false)
+		require.NoError(t, err)
+		require.Len(t, report, 1)
+		require.Len(t, report[0].Images, 1)
+		require.Equal(t, helpers.Digest3, report[0].Images[0].RepoDigest)
+		require.True(t, report[0].Images[0].SeenInLastReport)
+		require.Len(t, report[0].ImageFilesystems, 1)
+		require.Equal(t, uint64(2000), report[0].ImageFilesystems[0].UsedBytes)
+
+		report, err = r.GetReportForNode(helpers.Node1, true)
+		require.NoError(t, err)
+		require.Len(t, report, 1)
+		require.Len(t, report[0].Images, 3)
+
+		digests, err := r.GetDigestsByNameAndAfter("docker.io/nginx:latest", time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{helpers.Digest1, helpers.Digest3}, digests)
+
+		ids, err := r.GetIDsByNameAndAfter("docker.io/nginx:latest", time.Now())
+		require.NoError(t, err)
+		require.Empty(t, ids)
+
+		counts, err := r.CountRecords()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), counts["nodes"])
+		require.Equal(t, int64(3), counts["image_reports"])
+		require.Equal(t, int64(1), counts["image_filesystem_reports"])
+
+		// reports older than retention are removed, the node is kept until it is not seen for a day
+		r.SetRetention(1)
+		time.Sleep(time.Second)
+		err = r.CleanStaleRecords(-24 * time.Hour)
+		require.NoError(t, err)
+
+		counts, err = r.CountRecords()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), counts["nodes"])
+		require.Equal(t, int64(0), counts["image_reports"])
+		require.Equal(t, int64(0), counts["image_filesystem_reports"])
+
+		require.NoError(t, r.CheckWritable())
+	})
+}
+
+func TestRepo_Migrations(t *testing.T) {
+	helpers.ForEachBackend(t, func(t *testing.T, dsn string) {
+		if dsn == repo.MemoryDSN {
+			_, err := repo.MigrateStore(dsn, repo.SchemaVersion())
+			require.ErrorIs(t, err, repo.ErrNoSchema)
+			return
+		}
+
+		// stores created before migrations were versioned are taken over
+		err := repo.CreateUnversionedSchema(dsn)
+		require.NoError(t, err)
+
+		r := helpers.OpenTestRepo(t, dsn)
+		err = r.StoreDecisions([]repo.Decision{{Image: "docker.io/nginx:1.25", Verdict: repo.VerdictAllowed}})
+		require.NoError(t, err)
+
+		version, err := repo.MigrateStore(dsn, repo.SchemaVersion())
+		require.NoError(t, err)
+		require.Equal(t, repo.SchemaVersion(), version)
+
+		// down to nothing and up again
+		version, err = repo.MigrateStore(dsn, 0)
+		require.NoError(t, err)
+		require.Equal(t, repo.SchemaVersion(), version)
+
+		has, err := repo.HasTable(dsn, "decisions")
+		require.NoError(t, err)
+		require.False(t, has)
+
+		version, err = repo.MigrateStore(dsn, 1)
+		require.NoError(t, err)
+		require.Equal(t, uint(0), version)
+
+		version, err = repo.MigrateStore(dsn, repo.SchemaVersion())
+		require.NoError(t, err)
+		require.Equal(t, uint(1), version)
+
+		has, err = repo.HasTable(dsn, "decisions")
+		require.NoError(t, err)
+		require.True(t, has)
+
+		_, err = repo.MigrateStore(dsn, repo.SchemaVersion()+1)
+		require.ErrorIs(t, err, repo.ErrNewerSchema)
+
+		// a store migrated by a newer controller is refused
+		err = repo.StoreSchemaMigration(dsn, repo.SchemaVersion()+1)
+		require.NoError(t, err)
+
+		_, err = repo.NewStore(dsn, 1, 1, 1)
+		require.ErrorIs(t, err, repo.ErrNewerSchema)
+
+		_, err = repo.MigrateStore(dsn, 0)
+		require.ErrorIs(t, err, repo.ErrNewerSchema)
+	})
 }
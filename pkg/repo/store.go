@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/audit"
+)
+
+// Store keeps agent reports, the decision log and the audit trail of the controller.
+// Repo implements it on top of SQLite or PostgreSQL and MemoryRepo in memory, see NewStore.
+type Store interface {
+	StoreReport(node *Node, fsUsage []ImageFilesystemReport, images []ImageReport) error
+	GetReportForNode(node string, all bool) ([]Node, error)
+	GetDigestsByNameAndAfter(name string, after time.Time) ([]string, error)
+	GetIDsByNameAndAfter(name string, after time.Time) ([]string, error)
+
+	StoreDecisions(decisions []Decision) error
+	GetDecisions(filter DecisionFilter) ([]Decision, error)
+
+	StoreRulesChange(source string, rules []byte) (bool, error)
+	GetAuditRecords(fromID uint64, limit int) ([]audit.Record, error)
+	SignAuditHead(key ed25519.PrivateKey) (*audit.Head, error)
+	VerifyAudit(key ed25519.PublicKey) (int, error)
+
+	CountRecords() (map[string]int64, error)
+	CheckWritable() error
+
+	RunStaleRecordsCleaner()
+	StopStaleRecordsCleaner()
+	Close() error
+}
+
+var _ Store = Repo{}
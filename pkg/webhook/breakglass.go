@@ -0,0 +1,267 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationBreakGlass on a pod or a pod template bypasses denials. Its value is
+// the justification in the form of "<ticket>: <reason>".
+const AnnotationBreakGlass = "kiw.io/break-glass"
+
+const breakGlassEventReason = "BreakGlass"
+
+var (
+	ErrBreakGlassNotAllowed    = errors.New("break-glass is not allowed")
+	ErrBreakGlassJustification = errors.New("break-glass justification should be '<ticket>: <reason>'")
+)
+
+type BreakGlassConfig struct {
+	// Groups of users who are allowed to use the break-glass annotation.
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+// BreakGlass checks who uses the break-glass annotation and makes every bypass visible.
+type BreakGlass struct {
+	groups []string
+	client kubernetes.Interface
+}
+
+// NewBreakGlass returns BreakGlass which reports bypasses as Kubernetes events if the client is given.
+func NewBreakGlass(config BreakGlassConfig, client kubernetes.Interface) *BreakGlass {
+	return &BreakGlass{
+		groups: config.Groups,
+		client: client,
+	}
+}
+
+func NewBreakGlassFromFile(file string, client kubernetes.Interface) (*BreakGlass, error) {
+	config, err := readConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBreakGlass(config.BreakGlass, client), nil
+}
+
+// check returns the justification of the break-glass annotation or empty string if there is no annotation.
+// An annotation without a justification is an error as well as one added or changed by users who are not
+// in the allowed groups. Others may keep it, e.g. when scaling an annotated workload.
+func (b *BreakGlass) check(request *admissionv1.AdmissionRequest, object *podObject) (string, error) {
+	justification, ok := object.Meta.Annotations[AnnotationBreakGlass]
+	if !ok {
+		return "", nil
+	}
+
+	ticket, reason, _ := strings.Cut(justification, ":")
+	ticket, reason = strings.TrimSpace(ticket), strings.TrimSpace(reason)
+	if ticket == "" || reason == "" {
+		return "", fmt.Errorf("%w, got '%s'", ErrBreakGlassJustification, justification)
+	}
+
+	// objects created by their controllers carry the annotation of the owner, it is checked by authorize if used
+	if isChanged(request, object) && !isControlled(request, object) && !b.isAllowed(request.UserInfo.Groups) {
+		return "", fmt.Errorf("%w for user '%s'", ErrBreakGlassNotAllowed, request.UserInfo.Username)
+	}
+
+	return ticket + ": " + reason, nil
+}
+
+// authorize checks that the break-glass annotation may bypass denials of the object. Besides users of the
+// allowed groups, it may be used by controllers creating objects from the annotated template of their owner.
+func (b *BreakGlass) authorize(ctx context.Context, request *admissionv1.AdmissionRequest, object *podObject) error {
+	if b.isAllowed(request.UserInfo.Groups) {
+		return nil
+	}
+
+	if isControlled(request, object) {
+		inherited, err := b.isInherited(ctx, request.Namespace, object)
+		if err != nil {
+			log.Printf("error when getting owner of %s %s/%s: %s\n", object.Kind, request.Namespace, object.Name, err)
+		}
+		if inherited {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w for user '%s'", ErrBreakGlassNotAllowed, request.UserInfo.Username)
+}
+
+// isChanged reports whether the request adds the break-glass annotation or changes its justification.
+func isChanged(request *admissionv1.AdmissionRequest, object *podObject) bool {
+	if request.Operation != admissionv1.Update || len(request.OldObject.Raw) == 0 {
+		return true
+	}
+
+	oldObject, err := decodePodObject(request.Kind.Kind, request.OldObject.Raw)
+	if err != nil {
+		return true
+	}
+
+	justification, ok := oldObject.Meta.Annotations[AnnotationBreakGlass]
+	return !ok || justification != object.Meta.Annotations[AnnotationBreakGlass]
+}
+
+// controllerAccounts are users of built-in controllers creating objects of the owner kind, as kube-controller-manager
+// runs them with their own service accounts.
+var controllerAccounts = map[string]string{
+	"Deployment":  "system:serviceaccount:kube-system:deployment-controller",
+	"ReplicaSet":  "system:serviceaccount:kube-system:replicaset-controller",
+	"StatefulSet": "system:serviceaccount:kube-system:statefulset-controller",
+	"DaemonSet":   "system:serviceaccount:kube-system:daemon-set-controller",
+	"Job":         "system:serviceaccount:kube-system:job-controller",
+	"CronJob":     "system:serviceaccount:kube-system:cronjob-controller",
+}
+
+// isControlled reports whether the object is being created by its controller, e.g. a pod by its ReplicaSet.
+// The owner reference is set by whoever creates the object, so the request must come from the controller of the owner kind.
+func isControlled(request *admissionv1.AdmissionRequest, object *podObject) bool {
+	if request.Operation != admissionv1.Create || object.Controller == nil {
+		return false
+	}
+
+	account, ok := controllerAccounts[object.Controller.Kind]
+	return ok && request.UserInfo.Username == account
+}
+
+// isInherited checks that the controller of the object has the same break-glass annotation and every image of the object
+// in its pod template, which was checked when the annotation was added to the owner. The owner can't be checked without Kubernetes API.
+func (b *BreakGlass) isInherited(ctx context.Context, namespace string, object *podObject) (bool, error) {
+	if b == nil || b.client == nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	owner := object.Controller
+	var meta *metav1.ObjectMeta
+	var template *corev1.PodTemplateSpec
+
+	switch owner.Kind {
+	case "Deployment":
+		obj, err := b.client.AppsV1().Deployments(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		meta, template = &obj.ObjectMeta, &obj.Spec.Template
+	case "StatefulSet":
+		obj, err := b.client.AppsV1().StatefulSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		meta, template = &obj.ObjectMeta, &obj.Spec.Template
+	case "DaemonSet":
+		obj, err := b.client.AppsV1().DaemonSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		meta, template = &obj.ObjectMeta, &obj.Spec.Template
+	case "ReplicaSet":
+		obj, err := b.client.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		meta, template = &obj.ObjectMeta, &obj.Spec.Template
+	case "Job":
+		obj, err := b.client.BatchV1().Jobs(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		meta, template = &obj.ObjectMeta, &obj.Spec.Template
+	case "CronJob":
+		obj, err := b.client.BatchV1().CronJobs(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		meta, template = &obj.ObjectMeta, &obj.Spec.JobTemplate.Spec.Template
+	default:
+		return false, nil
+	}
+
+	justification, ok := template.Annotations[AnnotationBreakGlass]
+	if meta.UID != owner.UID || !ok || justification != object.Meta.Annotations[AnnotationBreakGlass] {
+		return false, nil
+	}
+
+	// images of the template were validated when the owner was admitted, others could be bypassed with its annotation
+	images := map[string]bool{}
+	for _, container := range getContainers(&template.Spec, "") {
+		images[container.Image] = true
+	}
+
+	for _, container := range getContainers(object.Spec, "") {
+		if !images[container.Image] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (b *BreakGlass) isAllowed(groups []string) bool {
+	if b == nil {
+		return false
+	}
+
+	for _, group := range groups {
+		if slices.Contains(b.groups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// record logs the bypass and reports it as a Warning event of the object.
+func (b *BreakGlass) record(ctx context.Context, review *admissionv1.AdmissionReview, object *podObject, violations []verdict, justification string) {
+	message := fmt.Sprintf("BREAK-GLASS by user '%s' (%s): %s", review.Request.UserInfo.Username, justification, violationsMessage(violations))
+	log.Printf("%s %s/%s %s\n", review.Request.Kind.Kind, review.Request.Namespace, requestObjectName(review, object), message)
+
+	if err := b.createEvent(ctx, review, object, message); err != nil {
+		log.Printf("error when creating break-glass event: %s", err)
+	}
+}
+
+func (b *BreakGlass) createEvent(ctx context.Context, review *admissionv1.AdmissionReview, object *podObject, message string) error {
+	// webhooks are registered with NoneOnDryRun side effects
+	if b.client == nil || (review.Request.DryRun != nil && *review.Request.DryRun) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "kiw-break-glass-",
+			Namespace:    review.Request.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      object.Kind,
+			Namespace: review.Request.Namespace,
+			Name:      requestObjectName(review, object),
+		},
+		Reason:         breakGlassEventReason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "k8s-image-warden"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := b.client.CoreV1().Events(review.Request.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
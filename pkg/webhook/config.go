@@ -0,0 +1,25 @@
+package webhook
+
+import (
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the part of the rules file which is handled by webhooks rather than by the engine.
+type config struct {
+	Exclusions Exclusions       `yaml:"exclusions"`
+	BreakGlass BreakGlassConfig `yaml:"breakGlass"`
+}
+
+func readConfig(file string) (config, error) {
+	var config config
+
+	yamlFile, err := os.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+
+	err = yaml.Unmarshal(yamlFile, &config)
+	return config, err
+}
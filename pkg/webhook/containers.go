@@ -0,0 +1,216 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var ErrUnsupportedKind = errors.New("unsupported kind")
+
+// podObject is a pod or a pod template of a workload together with JSON pointers to its metadata and spec.
+type podObject struct {
+	Kind  string
+	Name  string
+	Owner string
+	// Controller is the owner reference of the controller managing the object, if any.
+	Controller *metav1.OwnerReference
+	Meta       *metav1.ObjectMeta
+	Spec       *corev1.PodSpec
+	MetaPath   string
+	SpecPath   string
+}
+
+const (
+	podMetaPath             = "/metadata"
+	podSpecPath             = "/spec"
+	templateMetaPath        = "/spec/template/metadata"
+	templateSpecPath        = "/spec/template/spec"
+	cronJobTemplateMetaPath = "/spec/jobTemplate/spec/template/metadata"
+	cronJobTemplateSpecPath = "/spec/jobTemplate/spec/template/spec"
+)
+
+// IsPod reports whether the object is a pod rather than a workload with a pod template.
+func (o *podObject) IsPod() bool {
+	return o.MetaPath == podMetaPath
+}
+
+// decodePodObject extracts the pod spec of the given kind. Empty kind is treated as Pod.
+func decodePodObject(kind string, raw []byte) (*podObject, error) {
+	var template *corev1.PodTemplateSpec
+	var meta *metav1.ObjectMeta
+	metaPath, specPath := templateMetaPath, templateSpecPath
+
+	switch kind {
+	case "", "Pod":
+		pod := corev1.Pod{}
+		if err := json.Unmarshal(raw, &pod); err != nil {
+			return nil, err
+		}
+		return &podObject{
+			Kind:       "Pod",
+			Name:       objectName(&pod.ObjectMeta),
+			Owner:      objectOwner(&pod.ObjectMeta),
+			Controller: metav1.GetControllerOf(&pod.ObjectMeta),
+			Meta:       &pod.ObjectMeta,
+			Spec:       &pod.Spec,
+			MetaPath:   podMetaPath,
+			SpecPath:   podSpecPath,
+		}, nil
+	case "Deployment":
+		obj := appsv1.Deployment{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		template = &obj.Spec.Template
+		meta = &obj.ObjectMeta
+	case "StatefulSet":
+		obj := appsv1.StatefulSet{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		template = &obj.Spec.Template
+		meta = &obj.ObjectMeta
+	case "DaemonSet":
+		obj := appsv1.DaemonSet{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		template = &obj.Spec.Template
+		meta = &obj.ObjectMeta
+	case "ReplicaSet":
+		obj := appsv1.ReplicaSet{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		template = &obj.Spec.Template
+		meta = &obj.ObjectMeta
+	case "Job":
+		obj := batchv1.Job{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		template = &obj.Spec.Template
+		meta = &obj.ObjectMeta
+	case "CronJob":
+		obj := batchv1.CronJob{}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		template = &obj.Spec.JobTemplate.Spec.Template
+		meta = &obj.ObjectMeta
+		metaPath, specPath = cronJobTemplateMetaPath, cronJobTemplateSpecPath
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKind, kind)
+	}
+
+	return &podObject{
+		Kind:       kind,
+		Name:       objectName(meta),
+		Owner:      objectOwner(meta),
+		Controller: metav1.GetControllerOf(meta),
+		Meta:       &template.ObjectMeta,
+		Spec:       &template.Spec,
+		MetaPath:   metaPath,
+		SpecPath:   specPath,
+	}, nil
+}
+
+// podContainer is a container, init container or ephemeral container of a pod
+// together with the JSON pointer to it.
+type podContainer struct {
+	Kind       string
+	Path       string
+	Name       string
+	Image      string
+	PullPolicy corev1.PullPolicy
+}
+
+const (
+	containersKind          = "containers"
+	initContainersKind      = "initContainers"
+	ephemeralContainersKind = "ephemeralContainers"
+)
+
+// objectName falls back to generateName, as names of pods created by controllers are not known at admission.
+func objectName(meta *metav1.ObjectMeta) string {
+	if meta.Name != "" {
+		return meta.Name
+	}
+	return meta.GenerateName
+}
+
+func objectOwner(meta *metav1.ObjectMeta) string {
+	for _, owner := range meta.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			return owner.Kind + "/" + owner.Name
+		}
+	}
+
+	if len(meta.OwnerReferences) > 0 {
+		return meta.OwnerReferences[0].Kind + "/" + meta.OwnerReferences[0].Name
+	}
+
+	return ""
+}
+
+// getContainers lists all containers of the pod spec located by specPath.
+func getContainers(spec *corev1.PodSpec, specPath string) []podContainer {
+	containers := make([]podContainer, 0, len(spec.InitContainers)+len(spec.Containers)+len(spec.EphemeralContainers))
+
+	for i, container := range spec.InitContainers {
+		containers = append(containers, podContainer{
+			Kind:       initContainersKind,
+			Path:       specPath + "/" + initContainersKind + "/" + strconv.Itoa(i),
+			Name:       container.Name,
+			Image:      container.Image,
+			PullPolicy: container.ImagePullPolicy,
+		})
+	}
+
+	for i, container := range spec.Containers {
+		containers = append(containers, podContainer{
+			Kind:       containersKind,
+			Path:       specPath + "/" + containersKind + "/" + strconv.Itoa(i),
+			Name:       container.Name,
+			Image:      container.Image,
+			PullPolicy: container.ImagePullPolicy,
+		})
+	}
+
+	for i, container := range spec.EphemeralContainers {
+		containers = append(containers, podContainer{
+			Kind:       ephemeralContainersKind,
+			Path:       specPath + "/" + ephemeralContainersKind + "/" + strconv.Itoa(i),
+			Name:       container.Name,
+			Image:      container.Image,
+			PullPolicy: container.ImagePullPolicy,
+		})
+	}
+
+	return containers
+}
+
+// getChangedContainers returns containers which are new or have a different image than before the update.
+func getChangedContainers(containers, oldContainers []podContainer) []podContainer {
+	oldImages := make(map[string]string, len(oldContainers))
+	for _, container := range oldContainers {
+		oldImages[container.Kind+"/"+container.Name] = container.Image
+	}
+
+	var changed []podContainer
+	for _, container := range containers {
+		image, ok := oldImages[container.Kind+"/"+container.Name]
+		if !ok || image != container.Image {
+			changed = append(changed, container)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/repo"
+	admissionv1 "k8s.io/api/admission/v1"
+	imagepolicyv1alpha1 "k8s.io/api/imagepolicy/v1alpha1"
+)
+
+// decision modes of the webhooks, as handlers shadow the repo package
+const (
+	modeMutate      = repo.ModeWebhookMutate
+	modeValidate    = repo.ModeWebhookValidate
+	modeImagePolicy = repo.ModeImagePolicy
+)
+
+// requestObjectName prefers the name of the request, as the object may have only generateName.
+func requestObjectName(review *admissionv1.AdmissionReview, object *podObject) string {
+	if review.Request.Name != "" {
+		return review.Request.Name
+	}
+	return object.Name
+}
+
+func newDecision(review *admissionv1.AdmissionReview, object *podObject, mode string) repo.Decision {
+	return repo.Decision{
+		Timestamp: time.Now().UTC(),
+		Namespace: review.Request.Namespace,
+		Object:    object.Kind + "/" + requestObjectName(review, object),
+		Owner:     object.Owner,
+		Mode:      mode,
+	}
+}
+
+func validationDecisions(review *admissionv1.AdmissionReview, object *podObject, verdicts []verdict) []repo.Decision {
+	decisions := make([]repo.Decision, len(verdicts))
+	for i, v := range verdicts {
+		decisions[i] = newDecision(review, object, repo.ModeWebhookValidate)
+		decisions[i].Container = v.Container
+		decisions[i].Image = v.Image
+		decisions[i].Rule = v.Rule
+		decisions[i].Reason = v.Reason
+		switch {
+		case v.Allowed:
+			decisions[i].Verdict = repo.VerdictAllowed
+		case v.Bypassed:
+			decisions[i].Verdict = repo.VerdictBypassed
+		default:
+			decisions[i].Verdict = repo.VerdictDenied
+		}
+		if v.Shadow != nil {
+			decisions[i].ShadowVerdict = v.Shadow.Verdict()
+			decisions[i].ShadowRule = v.Shadow.Rule
+		}
+	}
+
+	return decisions
+}
+
+// imagePolicyDecisions records verdicts of an ImageReview, which has neither the pod nor container names.
+func imagePolicyDecisions(review *imagepolicyv1alpha1.ImageReview, verdicts []verdict) []repo.Decision {
+	decisions := make([]repo.Decision, len(verdicts))
+	for i, v := range verdicts {
+		decisions[i] = repo.Decision{
+			Timestamp: time.Now().UTC(),
+			Namespace: review.Spec.Namespace,
+			Image:     v.Image,
+			Verdict:   repo.VerdictDenied,
+			Rule:      v.Rule,
+			Reason:    v.Reason,
+			Mode:      modeImagePolicy,
+		}
+		if v.Allowed {
+			decisions[i].Verdict = repo.VerdictAllowed
+		}
+		if v.Shadow != nil {
+			decisions[i].ShadowVerdict = v.Shadow.Verdict()
+			decisions[i].ShadowRule = v.Shadow.Rule
+		}
+	}
+
+	return decisions
+}
+
+func mutationDecisions(review *admissionv1.AdmissionReview, object *podObject, results []containerMutation) []repo.Decision {
+	decisions := make([]repo.Decision, len(results))
+	for i, result := range results {
+		decisions[i] = newDecision(review, object, repo.ModeWebhookMutate)
+		decisions[i].Container = result.Container
+		decisions[i].Image = result.Image
+		decisions[i].Rule = strings.Join(result.Rules, ",")
+		decisions[i].Verdict = repo.VerdictUnchanged
+		if result.Mutated {
+			decisions[i].Verdict = repo.VerdictMutated
+		}
+	}
+
+	return decisions
+}
+
+// excludedDecisions records containers of the request which bypassed the rules.
+func excludedDecisions(review *admissionv1.AdmissionReview, object *podObject, containers []podContainer, mode, reason string) []repo.Decision {
+	decisions := make([]repo.Decision, len(containers))
+	for i, container := range containers {
+		decisions[i] = newDecision(review, object, mode)
+		decisions[i].Container = container.Name
+		decisions[i].Image = container.Image
+		decisions[i].Reason = reason
+		decisions[i].Verdict = repo.VerdictExcluded
+	}
+
+	return decisions
+}
+
+// storeDecisions keeps the decisions in the repo, if there is one. Failing to store
+// a decision doesn't affect the admission response.
+func storeDecisions(repo repo.Store, decisions []repo.Decision) {
+	if repo == nil || len(decisions) == 0 {
+		return
+	}
+
+	if err := repo.StoreDecisions(decisions); err != nil {
+		log.Printf("error when storing decisions: %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var ErrWrongLabelSelector = errors.New("wrong label selector")
+
+// Exclusions lists requests which bypass the rules. They are configured in the rules file
+// next to the rules, so they apply regardless of how the webhook configuration is installed.
+type Exclusions struct {
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// LabelSelectors are matched against labels of the pod or the pod template of the workload.
+	LabelSelectors []string `yaml:"labelSelectors,omitempty"`
+	Usernames      []string `yaml:"usernames,omitempty"`
+	Groups         []string `yaml:"groups,omitempty"`
+
+	selectors []labels.Selector
+}
+
+func NewExclusions(exclusions Exclusions) (*Exclusions, error) {
+	exclusions.selectors = make([]labels.Selector, len(exclusions.LabelSelectors))
+	for i, selector := range exclusions.LabelSelectors {
+		// empty selector matches everything, which is never what is meant
+		if strings.TrimSpace(selector) == "" {
+			return nil, fmt.Errorf("%w: empty selector", ErrWrongLabelSelector)
+		}
+
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrWrongLabelSelector, err)
+		}
+		exclusions.selectors[i] = parsed
+	}
+
+	return &exclusions, nil
+}
+
+func NewExclusionsFromFile(file string) (*Exclusions, error) {
+	config, err := readConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewExclusions(config.Exclusions)
+}
+
+// match returns the reason why the request is excluded or empty string if it is not.
+func (e *Exclusions) match(request *admissionv1.AdmissionRequest, object *podObject) string {
+	if e == nil {
+		return ""
+	}
+
+	if slices.Contains(e.Namespaces, request.Namespace) {
+		return fmt.Sprintf("excluded by namespace '%s'", request.Namespace)
+	}
+
+	if slices.Contains(e.Usernames, request.UserInfo.Username) {
+		return fmt.Sprintf("excluded by username '%s'", request.UserInfo.Username)
+	}
+
+	for _, group := range request.UserInfo.Groups {
+		if slices.Contains(e.Groups, group) {
+			return fmt.Sprintf("excluded by group '%s'", group)
+		}
+	}
+
+	objectLabels := labels.Set(object.Meta.Labels)
+	for i, selector := range e.selectors {
+		if selector.Matches(objectLabels) {
+			return fmt.Sprintf("excluded by label selector '%s'", e.LabelSelectors[i])
+		}
+	}
+
+	return ""
+}
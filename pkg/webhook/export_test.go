@@ -3,12 +3,9 @@ package webhook
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	"github.com/surik/k8s-image-warden/pkg/repo"
 )
 
-func MutateHandler(engine *engine.Engine, c *gin.Context) {
-	mutateHandler(engine, c)
-}
-
-func ValidateHandler(engine *engine.Engine, c *gin.Context) {
-	validateHandler(engine, c)
+func RegisterHandlers(r gin.IRoutes, engine *engine.Engine, exclusions *Exclusions, breakGlass *BreakGlass, repo repo.Store) {
+	registerHandlers(r, engine, exclusions, breakGlass, repo)
 }
@@ -3,68 +3,178 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	"github.com/surik/k8s-image-warden/pkg/registry"
+	"github.com/surik/k8s-image-warden/pkg/repo"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const admissionReviewKind = "AdmissionReview"
+
+var ErrBadAdmissionReview = errors.New("bad admission review")
+
+const (
+	AnnotationOriginalImagePrefix = "kiw.io/original-image."
+	AnnotationMutatedBy           = "kiw.io/mutated-by"
+)
+
 type Patch struct {
-	Op    string `json:"op"`
-	Path  string `json:"path"`
-	Value string `json:"value"`
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
 }
 
-func mutateHandler(engine *engine.Engine, c *gin.Context) {
+func mutateHandler(engine *engine.Engine, exclusions *Exclusions, repo repo.Store, c *gin.Context) {
+	verdict := verdictError
+	defer func(start time.Time) {
+		observeRequest(webhookMutate, verdict, start)
+	}(time.Now())
+
 	review, err := getAdmissionReview(c)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, err)
+		badRequest(c, err)
 		return
 	}
 
-	log.Printf("mutate for %s\n", review.Request.Name)
+	log.Printf("mutate for %s %s (%s)\n", review.Request.Kind.Kind, review.Request.Name, review.Request.Operation)
+
+	if !shouldEvaluate(review) {
+		verdict = verdictUnchanged
+		allow(c, review)
+		return
+	}
 
-	pod, err := getPodFromAdmissionReview(review)
+	object, containers, err := getContainersFromAdmissionReview(review)
 	if err != nil {
+		verdict = verdictDenied
 		reject(c, review, http.StatusForbidden, err.Error())
 		return
 	}
 
-	patches := mutate(c, engine, pod)
+	if reason := exclusions.match(review.Request, object); reason != "" {
+		decisions := excludedDecisions(review, object, containers, modeMutate, reason)
+		storeDecisions(repo, decisions)
+		observeDecisions(webhookMutate, decisions)
+
+		verdict = verdictExcluded
+		allow(c, review)
+		return
+	}
+
+	// workload templates can be changed freely unlike running pods
+	podUpdate := object.IsPod() && review.Request.Operation == admissionv1.Update
+	patches, results := mutate(c, engine, object, containers, podUpdate)
+
+	decisions := mutationDecisions(review, object, results)
+	storeDecisions(repo, decisions)
+	observeDecisions(webhookMutate, decisions)
+
 	if len(patches) > 0 {
+		verdict = verdictMutated
 		allowWithPatches(c, review, patches)
 	} else {
+		verdict = verdictUnchanged
 		allow(c, review)
 	}
 }
 
-func validateHandler(engine *engine.Engine, c *gin.Context) {
+func validateHandler(engine *engine.Engine, exclusions *Exclusions, breakGlass *BreakGlass, repo repo.Store, c *gin.Context) {
+	verdict := verdictError
+	defer func(start time.Time) {
+		observeRequest(webhookValidate, verdict, start)
+	}(time.Now())
+
 	review, err := getAdmissionReview(c)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, err)
+		badRequest(c, err)
 		return
 	}
 
-	log.Printf("validate for %s\n", review.Request.Name)
+	log.Printf("validate for %s %s (%s)\n", review.Request.Kind.Kind, review.Request.Name, review.Request.Operation)
+
+	if !shouldEvaluate(review) {
+		verdict = verdictAllowed
+		allow(c, review)
+		return
+	}
 
-	pod, err := getPodFromAdmissionReview(review)
+	object, containers, err := getContainersFromAdmissionReview(review)
 	if err != nil {
+		verdict = verdictDenied
 		reject(c, review, http.StatusForbidden, err.Error())
 		return
 	}
 
-	valid, message := validate(c, engine, pod)
-	if valid {
+	if reason := exclusions.match(review.Request, object); reason != "" {
+		decisions := excludedDecisions(review, object, containers, modeValidate, reason)
+		storeDecisions(repo, decisions)
+		observeDecisions(webhookValidate, decisions)
+
+		verdict = verdictExcluded
 		allow(c, review)
-	} else {
-		reject(c, review, http.StatusForbidden, message)
+		return
+	}
+
+	justification, err := breakGlass.check(review.Request, object)
+	if err != nil {
+		verdict = verdictDenied
+		reject(c, review, http.StatusForbidden, err.Error())
+		return
+	}
+
+	verdicts := validate(requestContext(c, review.Request.Namespace, object), engine, containers)
+
+	violations := getViolations(verdicts)
+	if len(violations) > 0 && justification != "" {
+		if err := breakGlass.authorize(c, review.Request, object); err != nil {
+			verdict = verdictDenied
+			reject(c, review, http.StatusForbidden, err.Error())
+			return
+		}
+
+		bypass(verdicts, review.Request.UserInfo.Username, justification)
+	}
+
+	decisions := validationDecisions(review, object, verdicts)
+	storeDecisions(repo, decisions)
+	observeDecisions(webhookValidate, decisions)
+
+	switch {
+	case len(violations) == 0:
+		verdict = verdictAllowed
+		allowWithWarnings(c, review, getWarnings(verdicts))
+	case justification != "":
+		verdict = verdictBypassed
+		breakGlass.record(c, review, object, violations, justification)
+		allowWithWarnings(c, review, append(getWarnings(verdicts), "denials are bypassed by break-glass: "+violationsMessage(violations)))
+	default:
+		verdict = verdictDenied
+		reject(c, review, http.StatusForbidden, violationsMessage(violations))
+	}
+}
+
+// shouldEvaluate checks if the operation may bring new images. DELETE and CONNECT don't carry pods.
+func shouldEvaluate(review *admissionv1.AdmissionReview) bool {
+	switch review.Request.Operation {
+	case admissionv1.Delete, admissionv1.Connect:
+		return false
+	default:
+		return true
 	}
 }
 
@@ -82,11 +192,16 @@ func reject(c *gin.Context, review *admissionv1.AdmissionReview, code int, messa
 }
 
 func allow(c *gin.Context, review *admissionv1.AdmissionReview) {
+	allowWithWarnings(c, review, nil)
+}
+
+func allowWithWarnings(c *gin.Context, review *admissionv1.AdmissionReview, warnings []string) {
 	data := admissionv1.AdmissionReview{
 		TypeMeta: review.TypeMeta,
 		Response: &admissionv1.AdmissionResponse{
-			UID:     review.Request.UID,
-			Allowed: true,
+			UID:      review.Request.UID,
+			Allowed:  true,
+			Warnings: warnings,
 		},
 	}
 
@@ -115,74 +230,360 @@ func allowWithPatches(c *gin.Context, review *admissionv1.AdmissionReview, patch
 	c.JSON(http.StatusOK, data)
 }
 
+// getAdmissionReview reads v1 and v1beta1 reviews, they are the same on the wire.
+// Responses echo apiVersion and kind of the review, so v1beta1 clients get v1beta1 back.
 func getAdmissionReview(c *gin.Context) (*admissionv1.AdmissionReview, error) {
 	var review admissionv1.AdmissionReview
-	if err := c.Bind(&review); err != nil {
-		return nil, err
+	if err := c.ShouldBindJSON(&review); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadAdmissionReview, err)
+	}
+
+	if review.Kind != admissionReviewKind {
+		return nil, fmt.Errorf("%w: unexpected kind '%s'", ErrBadAdmissionReview, review.Kind)
+	}
+
+	switch review.APIVersion {
+	case admissionv1.SchemeGroupVersion.String(), admissionv1beta1.SchemeGroupVersion.String():
+	default:
+		return nil, fmt.Errorf("%w: unsupported apiVersion '%s'", ErrBadAdmissionReview, review.APIVersion)
+	}
+
+	if review.Request == nil {
+		return nil, fmt.Errorf("%w: request is missing", ErrBadAdmissionReview)
 	}
 
 	return &review, nil
 }
 
-func getPodFromAdmissionReview(review *admissionv1.AdmissionReview) (*corev1.Pod, error) {
-	raw := review.Request.Object.Raw
-	pod := corev1.Pod{}
-	if err := json.Unmarshal(raw, &pod); err != nil {
-		return nil, err
+// badRequest is returned for reviews which can't be answered, the API server treats it as a webhook failure.
+func badRequest(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+func getPodFromAdmissionReview(review *admissionv1.AdmissionReview) (*podObject, error) {
+	return decodePodObject(review.Request.Kind.Kind, review.Request.Object.Raw)
+}
+
+// getContainersFromAdmissionReview returns the pod or workload and its containers to be evaluated.
+// On UPDATE only the containers with changed images are returned.
+func getContainersFromAdmissionReview(review *admissionv1.AdmissionReview) (*podObject, []podContainer, error) {
+	object, err := getPodFromAdmissionReview(review)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	containers := getContainers(object.Spec, object.SpecPath)
+
+	if review.Request.Operation != admissionv1.Update || len(review.Request.OldObject.Raw) == 0 {
+		return object, containers, nil
+	}
+
+	oldObject, err := decodePodObject(review.Request.Kind.Kind, review.Request.OldObject.Raw)
+	if err != nil {
+		return nil, nil, err
 	}
-	return &pod, nil
+
+	return object, getChangedContainers(containers, getContainers(oldObject.Spec, oldObject.SpecPath)), nil
+}
+
+// verdict is the validation result of a container image.
+type verdict struct {
+	Container string
+	Image     string
+	Allowed   bool
+	Rule      string
+	Reason    string
+	Warning   bool
+	// Bypassed is set for denied images admitted by break-glass.
+	Bypassed bool
+	Shadow   *engine.Validation
 }
 
-func validate(ctx context.Context, ruleEngine *engine.Engine, pod *corev1.Pod) (bool, string) {
-	containers := make([]corev1.Container, 0, len(pod.Spec.Containers)+len(pod.Spec.InitContainers))
+// requestContext makes annotations of the pod available to the rules and its pull secrets to the registry.
+func requestContext(ctx context.Context, namespace string, object *podObject) context.Context {
+	secrets := registry.PullSecrets{Namespace: namespace, ServiceAccount: object.Spec.ServiceAccountName}
+	for _, ref := range object.Spec.ImagePullSecrets {
+		secrets.Names = append(secrets.Names, ref.Name)
+	}
 
-	containers = append(containers, pod.Spec.Containers...)
-	containers = append(containers, pod.Spec.InitContainers...)
+	return registry.WithPullSecrets(engine.WithAnnotations(ctx, object.Meta.Annotations), secrets)
+}
 
+// validate evaluates every container, so all violations can be reported at once.
+func validate(ctx context.Context, ruleEngine *engine.Engine, containers []podContainer) []verdict {
 	log.Printf("validate containers: %d\n", len(containers))
 
-	for _, container := range containers {
-		result, rule := ruleEngine.Validate(ctx, container.Image)
-		if !result {
-			return false, fmt.Sprintf("'%s' is not allowed by rule '%s'", container.Image, rule)
+	verdicts := make([]verdict, len(containers))
+	for i, container := range containers {
+		validation := ruleEngine.ValidateImage(ctx, container.Image)
+		verdicts[i] = verdict{
+			Container: container.Name,
+			Image:     container.Image,
+			Allowed:   validation.Allowed,
+			Rule:      validation.Rule,
+			Reason:    validation.Reason,
+			Warning:   validation.Warning,
+			Shadow:    validation.Shadow,
 		}
 	}
 
-	return true, ""
+	return verdicts
 }
 
-func mutate(ctx context.Context, ruleEngine *engine.Engine, pod *corev1.Pod) []Patch {
-	var patches []Patch
+func getViolations(verdicts []verdict) []verdict {
+	var violations []verdict
+	for _, v := range verdicts {
+		if !v.Allowed {
+			violations = append(violations, v)
+		}
+	}
+
+	return violations
+}
+
+// bypass marks denied images as admitted by break-glass of the user.
+func bypass(verdicts []verdict, username, justification string) {
+	for i := range verdicts {
+		if !verdicts[i].Allowed {
+			verdicts[i].Bypassed = true
+			verdicts[i].Reason = fmt.Sprintf("break-glass by '%s': %s", username, justification)
+		}
+	}
+}
 
-	initContainers := pod.Spec.InitContainers
+// getWarnings returns warnings for images allowed despite the rule couldn't be checked.
+func getWarnings(verdicts []verdict) []string {
+	var warnings []string
+	for _, v := range verdicts {
+		if v.Allowed && v.Warning {
+			warnings = append(warnings, fmt.Sprintf("'%s' of container '%s' is %s", v.Image, v.Container, v.Reason))
+		}
+	}
 
-	log.Printf("mutating init containers: %d\n", len(initContainers))
+	return warnings
+}
 
-	for i, container := range initContainers {
-		image, rules := ruleEngine.Mutate(ctx, container.Image)
-		if len(rules) > 0 {
-			patches = append(patches, Patch{
-				Op:    "replace",
-				Path:  "/spec/initContainers/" + strconv.Itoa(i) + "/image",
-				Value: image,
-			})
+func violationsMessage(violations []verdict) string {
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		messages[i] = fmt.Sprintf("'%s' of container '%s' is not allowed by rule '%s'", v.Image, v.Container, v.Rule)
+		if v.Reason != "" {
+			messages[i] += " (" + v.Reason + ")"
 		}
 	}
 
-	containers := pod.Spec.Containers
+	return strings.Join(messages, "; ")
+}
+
+// mutate returns patches for the given containers. On pod update pull secrets and pull policies
+// of existing containers can't be changed, so only ephemeral containers get their pull policy set.
+func mutate(ctx context.Context, ruleEngine *engine.Engine, object *podObject, containers []podContainer, update bool) ([]Patch, []containerMutation) {
+	var result mutation
 
 	log.Printf("mutating containers: %d\n", len(containers))
 
-	for i, container := range containers {
-		image, rules := ruleEngine.Mutate(ctx, container.Image)
-		if len(rules) > 0 {
-			patches = append(patches, Patch{
-				Op:    "replace",
-				Path:  "/spec/containers/" + strconv.Itoa(i) + "/image",
-				Value: image,
-			})
+	for _, container := range containers {
+		setPullPolicy := !update || container.Kind == ephemeralContainersKind
+		result.mutateContainer(ctx, ruleEngine, container, setPullPolicy)
+	}
+
+	patches := result.patches
+	if !update {
+		secretsPatches, added := pullSecretsPatches(object.SpecPath, object.Spec.ImagePullSecrets, result.pullSecrets)
+		patches = append(patches, secretsPatches...)
+		for _, secret := range added {
+			result.rules = append(result.rules, result.pullSecretRules[secret])
+		}
+	}
+	if len(patches) > 0 {
+		patches = append(patches, annotationsPatches(object.MetaPath, object.Meta.Annotations, result.annotations(object.Meta.Annotations))...)
+	}
+
+	return patches, result.containers
+}
+
+// mutation accumulates changes of all pod containers.
+type mutation struct {
+	patches     []Patch
+	pullSecrets []string
+	// pullSecretRules are the rules requiring the pull secrets, they are recorded once the secret is added.
+	pullSecretRules map[string]string
+	// rules are the rules which changed the pod.
+	rules          []string
+	originalImages []containerImage
+	containers     []containerMutation
+}
+
+// containerMutation is the mutation result of a single container.
+type containerMutation struct {
+	Container string
+	Image     string
+	Mutated   bool
+	Rules     []string
+}
+
+type containerImage struct {
+	container string
+	image     string
+}
+
+func (m *mutation) mutateContainer(ctx context.Context, ruleEngine *engine.Engine, container podContainer, setPullPolicy bool) {
+	patches := len(m.patches)
+
+	image, rules, err := ruleEngine.Mutate(ctx, container.Image)
+	if err != nil {
+		// e.g. images pinned only by digest keep their reference, pod mutations still apply
+		log.Printf("image of container %s is not mutated: %s\n", container.Name, err)
+	}
+	if len(rules) > 0 {
+		m.patches = append(m.patches, Patch{
+			Op:    "replace",
+			Path:  container.Path + "/image",
+			Value: image,
+		})
+		m.rules = append(m.rules, rules...)
+
+		if image != container.Image {
+			m.originalImages = append(m.originalImages, containerImage{container: container.Name, image: container.Image})
+		}
+	}
+
+	// pod mutations are evaluated against the already mutated image
+	podMutation, podRules := ruleEngine.MutatePod(ctx, image)
+	if setPullPolicy && podMutation.PullPolicy != "" && string(container.PullPolicy) != podMutation.PullPolicy {
+		// "add" replaces the value if the field is already set
+		m.patches = append(m.patches, Patch{
+			Op:    "add",
+			Path:  container.Path + "/imagePullPolicy",
+			Value: podMutation.PullPolicy,
+		})
+		m.rules = append(m.rules, podMutation.PullPolicyRule)
+	}
+
+	m.pullSecrets = append(m.pullSecrets, podMutation.PullSecrets...)
+	for secret, rule := range podMutation.PullSecretRules {
+		if m.pullSecretRules == nil {
+			m.pullSecretRules = make(map[string]string)
+		}
+		if _, ok := m.pullSecretRules[secret]; !ok {
+			m.pullSecretRules[secret] = rule
+		}
+	}
+
+	// no rule looked at the image, so there is no decision to record
+	if err != nil && len(podRules) == 0 {
+		return
+	}
+
+	m.containers = append(m.containers, containerMutation{
+		Container: container.Name,
+		Image:     container.Image,
+		Mutated:   len(m.patches) > patches,
+		Rules:     append(rules, podRules...),
+	})
+}
+
+// annotations returns annotations describing the mutation. Original images which are
+// already recorded are kept, as they were set by an earlier mutation.
+func (m *mutation) annotations(existing map[string]string) map[string]string {
+	annotations := make(map[string]string, len(m.originalImages)+1)
+	for _, original := range m.originalImages {
+		key := AnnotationOriginalImagePrefix + original.container
+		if _, ok := existing[key]; !ok {
+			annotations[key] = original.image
+		}
+	}
+
+	var rules []string
+	if mutatedBy, ok := existing[AnnotationMutatedBy]; ok && mutatedBy != "" {
+		rules = strings.Split(mutatedBy, ",")
+	}
+	for _, rule := range m.rules {
+		if !slices.Contains(rules, rule) {
+			rules = append(rules, rule)
+		}
+	}
+	annotations[AnnotationMutatedBy] = strings.Join(rules, ",")
+
+	return annotations
+}
+
+// pullSecretsPatches adds the secrets which are not yet referenced by the pod, the added secrets are returned as well.
+func pullSecretsPatches(specPath string, existing []corev1.LocalObjectReference, secrets []string) ([]Patch, []string) {
+	known := make(map[string]bool, len(existing))
+	for _, secret := range existing {
+		known[secret.Name] = true
+	}
+
+	var missing []corev1.LocalObjectReference
+	var added []string
+	for _, secret := range secrets {
+		if !known[secret] {
+			known[secret] = true
+			missing = append(missing, corev1.LocalObjectReference{Name: secret})
+			added = append(added, secret)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	if len(existing) == 0 {
+		return []Patch{{
+			Op:    "add",
+			Path:  specPath + "/imagePullSecrets",
+			Value: missing,
+		}}, added
+	}
+
+	patches := make([]Patch, len(missing))
+	for i, secret := range missing {
+		patches[i] = Patch{
+			Op:    "add",
+			Path:  specPath + "/imagePullSecrets/-",
+			Value: secret,
+		}
+	}
+
+	return patches, added
+}
+
+// annotationsPatches adds or replaces the annotations. Without any existing annotations
+// the whole map is added at once, as JSON patch can't add a member to a missing object.
+func annotationsPatches(metaPath string, existing, annotations map[string]string) []Patch {
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	if len(existing) == 0 {
+		return []Patch{{
+			Op:    "add",
+			Path:  metaPath + "/annotations",
+			Value: annotations,
+		}}
+	}
+
+	keys := maps.Keys(annotations)
+	sort.Strings(keys)
+
+	patches := make([]Patch, 0, len(keys))
+	for _, key := range keys {
+		op := "add"
+		if _, ok := existing[key]; ok {
+			op = "replace"
 		}
+
+		patches = append(patches, Patch{
+			Op:    op,
+			Path:  metaPath + "/annotations/" + escapeJSONPointer(key),
+			Value: annotations[key],
+		})
 	}
 
 	return patches
 }
+
+func escapeJSONPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
@@ -2,65 +2,1264 @@ package webhook_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/containers/image/v5/types"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	metricshelpers "github.com/surik/k8s-image-warden/pkg/metrics/testing"
+	"github.com/surik/k8s-image-warden/pkg/registry"
+	repoapi "github.com/surik/k8s-image-warden/pkg/repo"
+	helpers "github.com/surik/k8s-image-warden/pkg/repo/testing"
 	"github.com/surik/k8s-image-warden/pkg/webhook"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	imagepolicyv1alpha1 "k8s.io/api/imagepolicy/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	defaultRegistry = engine.Rule{
+		Name: "docker.io is default",
+		MutationRule: engine.MutationRule{
+			Type:     engine.MutationTypeDefaultRegistry,
+			Registry: "docker.io",
+		},
+	}
+
+	noLatest = engine.Rule{
+		Name: "No Latest",
+		ValidationRule: engine.ValidationRule{
+			Type:  engine.ValidateTypeLatest,
+			Allow: false,
+		},
+	}
 )
 
 func TestHandlers_Validate(t *testing.T) {
-	r := gin.Default()
+	r, _ := newTestRouter(t, []engine.Rule{defaultRegistry, noLatest}, routerOptions{})
+
+	t.Run("nginx:latest mutated to docker.io/nginx:latest", func(t *testing.T) {
+		resp := makeRequst(t, r, "mutate", "../../testdata/admission_review.json")
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+
+		require.Len(t, patches, 2)
+		require.Equal(t, "docker.io/nginx:latest", patches[0].Value)
+		require.Equal(t, "add", patches[1].Op)
+		require.Equal(t, "/metadata/annotations", patches[1].Path)
+		require.Equal(t, map[string]interface{}{
+			webhook.AnnotationOriginalImagePrefix + "nginx": "nginx:latest",
+			webhook.AnnotationMutatedBy:                     "docker.io is default",
+		}, patches[1].Value)
+	})
+
+	t.Run("nginx:latest not valid because of latest tag", func(t *testing.T) {
+		resp := makeRequst(t, r, "validate", "../../testdata/admission_review.json")
+		require.Equal(t, false, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, "No Latest")
+	})
+}
+
+func TestHandlers_AdmissionReviewVersions(t *testing.T) {
+	r, _ := newTestRouter(t, []engine.Rule{noLatest}, routerOptions{})
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:latest"}},
+		},
+	}
 
+	t.Run("v1beta1 is answered with v1beta1", func(t *testing.T) {
+		review := newAdmissionReview(t, pod)
+		review.APIVersion = "admission.k8s.io/v1beta1"
+
+		for _, action := range []string{"mutate", "validate"} {
+			resp := makeReviewRequest(t, r, action, review)
+			require.Equal(t, "admission.k8s.io/v1beta1", resp.APIVersion)
+			require.Equal(t, "AdmissionReview", resp.Kind)
+			require.Equal(t, review.Request.UID, resp.Response.UID)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		body  string
+		error string
+	}{
+		{"Request is missing", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`, "request is missing"},
+		{"Unsupported version", `{"apiVersion": "admission.k8s.io/v2", "kind": "AdmissionReview", "request": {}}`, "unsupported apiVersion 'admission.k8s.io/v2'"},
+		{"Unexpected kind", `{"apiVersion": "admission.k8s.io/v1", "kind": "ImageReview", "request": {}}`, "unexpected kind 'ImageReview'"},
+		{"Not JSON", `admission`, webhook.ErrBadAdmissionReview.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, action := range []string{"mutate", "validate"} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(http.MethodPost, "/"+action, strings.NewReader(tt.body))
+				req.Header.Add("Content-Type", "application/json")
+				r.ServeHTTP(w, req)
+
+				require.Equal(t, http.StatusBadRequest, w.Code)
+				require.Contains(t, w.Body.String(), tt.error)
+			}
+		})
+	}
+}
+
+func TestHandlers_MutatePodSpec(t *testing.T) {
 	rules := []engine.Rule{
 		{
-			Name: "docker.io is default",
+			Name: "rewrite to mirror",
 			MutationRule: engine.MutationRule{
-				Type:     engine.MutationTypeDefaultRegistry,
-				Registry: "docker.io",
+				Type:        engine.MutationTypeRewriteRegistry,
+				Registry:    "docker.io",
+				NewRegistry: "mirror.mycompany.com",
 			},
 		},
 		{
-			Name: "No Latest",
+			Name: "mirror needs credentials",
+			MutationRule: engine.MutationRule{
+				Type:       engine.MutationTypePullSecret,
+				Registry:   `mirror\.mycompany\.com`,
+				PullSecret: "mirror-credentials",
+			},
+		},
+		{
+			Name: "always pull latest",
+			MutationRule: engine.MutationRule{
+				Type:     engine.MutationTypePullPolicy,
+				ImageTag: "^latest$",
+			},
+		},
+	}
+
+	r, _ := newTestRouter(t, rules, routerOptions{})
+
+	t.Run("pull secrets and pull policy are added", func(t *testing.T) {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "nginx", Image: "docker.io/nginx:latest", ImagePullPolicy: corev1.PullIfNotPresent},
+					{Name: "sidecar", Image: "docker.io/envoy:1.27.0", ImagePullPolicy: corev1.PullIfNotPresent},
+				},
+			},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, &pod))
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+
+		require.Len(t, patches, 5)
+		require.Equal(t, "/spec/containers/0/image", patches[0].Path)
+		require.Equal(t, "mirror.mycompany.com/nginx:latest", patches[0].Value)
+		require.Equal(t, "add", patches[1].Op)
+		require.Equal(t, "/spec/containers/0/imagePullPolicy", patches[1].Path)
+		require.Equal(t, "Always", patches[1].Value)
+		require.Equal(t, "/spec/containers/1/image", patches[2].Path)
+		require.Equal(t, "add", patches[3].Op)
+		require.Equal(t, "/spec/imagePullSecrets", patches[3].Path)
+		require.Equal(t, []interface{}{map[string]interface{}{"name": "mirror-credentials"}}, patches[3].Value)
+		require.Equal(t, "/metadata/annotations", patches[4].Path)
+		require.Equal(t, map[string]interface{}{
+			webhook.AnnotationOriginalImagePrefix + "nginx":   "docker.io/nginx:latest",
+			webhook.AnnotationOriginalImagePrefix + "sidecar": "docker.io/envoy:1.27.0",
+			webhook.AnnotationMutatedBy:                       "rewrite to mirror,always pull latest,mirror needs credentials",
+		}, patches[4].Value)
+	})
+
+	t.Run("patches are idempotent", func(t *testing.T) {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "mirror-credentials"}},
+				Containers: []corev1.Container{
+					{Name: "nginx", Image: "mirror.mycompany.com/nginx:latest", ImagePullPolicy: corev1.PullAlways},
+				},
+			},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, &pod))
+		require.True(t, resp.Response.Allowed)
+		require.Empty(t, resp.Response.Patch)
+	})
+
+	t.Run("pull secret is appended to existing ones", func(t *testing.T) {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other-credentials"}},
+				Containers: []corev1.Container{
+					{Name: "nginx", Image: "mirror.mycompany.com/nginx:1.25.2", ImagePullPolicy: corev1.PullIfNotPresent},
+				},
+			},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, &pod))
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+
+		require.Len(t, patches, 2)
+		require.Equal(t, "add", patches[0].Op)
+		require.Equal(t, "/spec/imagePullSecrets/-", patches[0].Path)
+		require.Equal(t, map[string]interface{}{"name": "mirror-credentials"}, patches[0].Value)
+		require.Equal(t, "/metadata/annotations", patches[1].Path)
+		require.Equal(t, map[string]interface{}{webhook.AnnotationMutatedBy: "mirror needs credentials"}, patches[1].Value)
+	})
+
+	t.Run("existing annotations are extended", func(t *testing.T) {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"team":                      "platform",
+					webhook.AnnotationMutatedBy: "some rule",
+				},
+			},
+			Spec: corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "mirror-credentials"}},
+				Containers: []corev1.Container{
+					{Name: "nginx", Image: "docker.io/nginx:1.25.2", ImagePullPolicy: corev1.PullIfNotPresent},
+				},
+			},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, &pod))
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+
+		require.Len(t, patches, 3)
+		require.Equal(t, "/spec/containers/0/image", patches[0].Path)
+		require.Equal(t, webhook.Patch{
+			Op:    "replace",
+			Path:  "/metadata/annotations/kiw.io~1mutated-by",
+			Value: "some rule,rewrite to mirror",
+		}, patches[1])
+		require.Equal(t, webhook.Patch{
+			Op:    "add",
+			Path:  "/metadata/annotations/kiw.io~1original-image.nginx",
+			Value: "docker.io/nginx:1.25.2",
+		}, patches[2])
+	})
+
+	t.Run("only rules which changed the pod are recorded", func(t *testing.T) {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "mirror-credentials"}},
+				Containers: []corev1.Container{
+					{Name: "nginx", Image: "docker.io/nginx:latest", ImagePullPolicy: corev1.PullAlways},
+				},
+			},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, &pod))
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+
+		require.Len(t, patches, 2)
+		require.Equal(t, "/spec/containers/0/image", patches[0].Path)
+		require.Equal(t, map[string]interface{}{
+			webhook.AnnotationOriginalImagePrefix + "nginx": "docker.io/nginx:latest",
+			webhook.AnnotationMutatedBy:                     "rewrite to mirror",
+		}, patches[1].Value)
+	})
+}
+
+func TestHandlers_Operations(t *testing.T) {
+	rules := []engine.Rule{
+		defaultRegistry,
+		{
+			Name: "always pull latest",
+			MutationRule: engine.MutationRule{
+				Type:     engine.MutationTypePullPolicy,
+				ImageTag: "^latest$",
+			},
+		},
+		noLatest,
+		{
+			Name: "Anything else",
 			ValidationRule: engine.ValidationRule{
-				Type:  engine.ValidateTypeLatest,
-				Allow: false,
+				Type:      engine.ValidateTypeLock,
+				ImageName: ".*",
+				ImageTag:  "1.25.2",
+				Allow:     true,
 			},
 		},
 	}
 
-	engine, err := engine.NewEngine(nil, nil, rules)
-	require.NoError(t, err)
+	r, _ := newTestRouter(t, rules, routerOptions{})
+
+	// the pod was admitted before the rules were introduced
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "nginx", Image: "docker.io/nginx:latest", ImagePullPolicy: corev1.PullIfNotPresent},
+			},
+		},
+	}
 
-	r.POST("/mutate", func(c *gin.Context) {
-		webhook.MutateHandler(engine, c)
+	debugged := *pod.DeepCopy()
+	debugged.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+				Name:            "debugger",
+				Image:           "busybox:latest",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+			},
+		},
+	}
+
+	t.Run("ephemeral container is validated on update", func(t *testing.T) {
+		resp := makeReviewRequest(t, r, "validate", newUpdateAdmissionReview(t, &pod, &debugged))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, "busybox:latest")
 	})
-	r.POST("/validate", func(c *gin.Context) {
-		webhook.ValidateHandler(engine, c)
+
+	t.Run("ephemeral container is mutated on update", func(t *testing.T) {
+		resp := makeReviewRequest(t, r, "mutate", newUpdateAdmissionReview(t, &pod, &debugged))
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+
+		require.Len(t, patches, 3)
+		require.Equal(t, "/spec/ephemeralContainers/0/image", patches[0].Path)
+		require.Equal(t, "docker.io/busybox:latest", patches[0].Value)
+		require.Equal(t, "/spec/ephemeralContainers/0/imagePullPolicy", patches[1].Path)
+		require.Equal(t, "/metadata/annotations", patches[2].Path)
 	})
 
-	t.Run("nginx:latest mutated to docker.io/nginx:latest", func(t *testing.T) {
-		resp := makeRequst(t, r, "mutate", "../../testdata/admission_review.json")
+	t.Run("all violations are reported", func(t *testing.T) {
+		bad := *debugged.DeepCopy()
+		bad.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "alpine:1.25.2"}}
+
+		resp := makeReviewRequest(t, r, "validate", newAdmissionReview(t, &bad))
+		require.False(t, resp.Response.Allowed)
+		require.Equal(t,
+			"'docker.io/nginx:latest' of container 'nginx' is not allowed by rule 'No Latest'; "+
+				"'busybox:latest' of container 'debugger' is not allowed by rule 'No Latest'",
+			resp.Response.Result.Message)
+	})
+
+	t.Run("unchanged containers are not evaluated on update", func(t *testing.T) {
+		updated := *pod.DeepCopy()
+		updated.Labels = map[string]string{"app": "nginx"}
+
+		resp := makeReviewRequest(t, r, "validate", newUpdateAdmissionReview(t, &pod, &updated))
+		require.True(t, resp.Response.Allowed)
+
+		resp = makeReviewRequest(t, r, "mutate", newUpdateAdmissionReview(t, &pod, &updated))
+		require.True(t, resp.Response.Allowed)
+		require.Empty(t, resp.Response.Patch)
+	})
+
+	t.Run("changed image is evaluated on update", func(t *testing.T) {
+		updated := *pod.DeepCopy()
+		updated.Spec.Containers[0].Image = "nginx:1.25.2"
+
+		resp := makeReviewRequest(t, r, "validate", newUpdateAdmissionReview(t, &pod, &updated))
+		require.True(t, resp.Response.Allowed)
+
+		resp = makeReviewRequest(t, r, "mutate", newUpdateAdmissionReview(t, &pod, &updated))
 
 		var patches []webhook.Patch
-		err = json.Unmarshal(resp.Response.Patch, &patches)
+		err := json.Unmarshal(resp.Response.Patch, &patches)
 		require.NoError(t, err)
 
-		require.Len(t, patches, 1)
-		require.Equal(t, "docker.io/nginx:latest", patches[0].Value)
+		require.Len(t, patches, 2)
+		require.Equal(t, "/spec/containers/0/image", patches[0].Path)
+		require.Equal(t, "docker.io/nginx:1.25.2", patches[0].Value)
 	})
 
-	t.Run("nginx:latest not valid because of latest tag", func(t *testing.T) {
-		resp := makeRequst(t, r, "validate", "../../testdata/admission_review.json")
-		require.Equal(t, false, resp.Response.Allowed)
+	t.Run("delete is allowed without a pod", func(t *testing.T) {
+		for _, action := range []string{"mutate", "validate"} {
+			review := newAdmissionReview(t, &pod)
+			review.Request.Operation = admissionv1.Delete
+			review.Request.OldObject = review.Request.Object
+			review.Request.Object = runtime.RawExtension{}
+
+			resp := makeReviewRequest(t, r, action, review)
+			require.True(t, resp.Response.Allowed)
+			require.Equal(t, review.Request.UID, resp.Response.UID)
+		}
+	})
+}
+
+func TestHandlers_Workloads(t *testing.T) {
+	r, _ := newTestRouter(t, []engine.Rule{defaultRegistry, noLatest}, routerOptions{})
+
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:latest"}},
+		},
+	}
+
+	workloads := []struct {
+		kind     string
+		object   interface{}
+		specPath string
+		metaPath string
+	}{
+		{"Deployment", appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}, "/spec/template/spec", "/spec/template/metadata"},
+		{"StatefulSet", appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: template}}, "/spec/template/spec", "/spec/template/metadata"},
+		{"DaemonSet", appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: template}}, "/spec/template/spec", "/spec/template/metadata"},
+		{"ReplicaSet", appsv1.ReplicaSet{Spec: appsv1.ReplicaSetSpec{Template: template}}, "/spec/template/spec", "/spec/template/metadata"},
+		{"Job", batchv1.Job{Spec: batchv1.JobSpec{Template: template}}, "/spec/template/spec", "/spec/template/metadata"},
+		{
+			"CronJob",
+			batchv1.CronJob{Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}}}},
+			"/spec/jobTemplate/spec/template/spec",
+			"/spec/jobTemplate/spec/template/metadata",
+		},
+	}
+
+	for _, workload := range workloads {
+		workload := workload
+
+		t.Run(workload.kind+" is validated", func(t *testing.T) {
+			resp := makeReviewRequest(t, r, "validate", newObjectAdmissionReview(t, workload.kind, "app", workload.object))
+			require.False(t, resp.Response.Allowed)
+			require.Contains(t, resp.Response.Result.Message, "No Latest")
+		})
+
+		t.Run(workload.kind+" is mutated", func(t *testing.T) {
+			resp := makeReviewRequest(t, r, "mutate", newObjectAdmissionReview(t, workload.kind, "app", workload.object))
+
+			var patches []webhook.Patch
+			err := json.Unmarshal(resp.Response.Patch, &patches)
+			require.NoError(t, err)
+
+			require.Len(t, patches, 2)
+			require.Equal(t, workload.specPath+"/containers/0/image", patches[0].Path)
+			require.Equal(t, "docker.io/nginx:latest", patches[0].Value)
+			require.Equal(t, workload.metaPath+"/annotations", patches[1].Path)
+		})
+	}
+
+	t.Run("unsupported kind is rejected", func(t *testing.T) {
+		resp := makeReviewRequest(t, r, "validate", newObjectAdmissionReview(t, "Service", "app", corev1.Service{}))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrUnsupportedKind.Error())
+	})
+}
+
+func TestHandlers_Decisions(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+	r, _ := newTestRouter(t, []engine.Rule{defaultRegistry, noLatest}, routerOptions{repo: repo})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "nginx", Image: "nginx:latest"},
+				{Name: "redis", Image: "docker.io/redis:7"},
+			},
+		},
+	}
+
+	review := newAdmissionReview(t, pod)
+	review.Request.Namespace = "default"
+
+	makeReviewRequest(t, r, "mutate", review)
+	makeReviewRequest(t, r, "validate", review)
+
+	decisions, err := repo.GetDecisions(repoapi.DecisionFilter{Mode: repoapi.ModeWebhookMutate})
+	require.NoError(t, err)
+	require.Len(t, decisions, 2)
+	require.ElementsMatch(t, []string{repoapi.VerdictMutated, repoapi.VerdictUnchanged},
+		[]string{decisions[0].Verdict, decisions[1].Verdict})
+
+	decisions, err = repo.GetDecisions(repoapi.DecisionFilter{Mode: repoapi.ModeWebhookValidate, Image: "nginx"})
+	require.NoError(t, err)
+	require.Len(t, decisions, 1)
+	require.Equal(t, "default", decisions[0].Namespace)
+	require.Equal(t, "Pod/app", decisions[0].Object)
+	require.Equal(t, "nginx", decisions[0].Container)
+	require.Equal(t, "nginx:latest", decisions[0].Image)
+	require.Equal(t, "No Latest", decisions[0].Rule)
+	require.Equal(t, repoapi.VerdictDenied, decisions[0].Verdict)
+
+	// requests and decisions are counted
+	body := metricshelpers.Scrape(t)
+	require.Contains(t, body, `kiw_webhook_requests_total{verdict="mutated",webhook="mutate"}`)
+	require.Contains(t, body, `kiw_webhook_requests_total{verdict="denied",webhook="validate"}`)
+	require.Contains(t, body, `kiw_webhook_request_duration_seconds_count{verdict="denied",webhook="validate"}`)
+	require.Contains(t, body, `kiw_webhook_decisions_total{rule="No Latest",verdict="denied",webhook="validate"}`)
+	require.Contains(t, body, `kiw_engine_rule_hits_total{rule="docker.io is default",type="mutate"}`)
+}
+
+func TestHandlers_DigestPinned(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+	r, _ := newTestRouter(t, []engine.Rule{defaultRegistry}, routerOptions{repo: repo})
+
+	image := "nginx@" + helpers.Digest1
+
+	t.Run("image pinned only by digest is admitted as is", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pinned"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: image}}},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, pod))
+		require.True(t, resp.Response.Allowed)
+		require.Empty(t, resp.Response.Patch)
+
+		decisions, err := repo.GetDecisions(repoapi.DecisionFilter{Mode: repoapi.ModeWebhookMutate})
+		require.NoError(t, err)
+		require.Empty(t, decisions)
+	})
+
+	t.Run("only tagged images of the pod are mutated", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "mixed"},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "nginx", Image: image},
+				{Name: "redis", Image: "redis:7"},
+			}},
+		}
+
+		resp := makeReviewRequest(t, r, "mutate", newAdmissionReview(t, pod))
+		require.True(t, resp.Response.Allowed)
+
+		var patches []webhook.Patch
+		err := json.Unmarshal(resp.Response.Patch, &patches)
+		require.NoError(t, err)
+		require.Len(t, patches, 2)
+		require.Equal(t, "/spec/containers/1/image", patches[0].Path)
+		require.Equal(t, map[string]interface{}{
+			webhook.AnnotationOriginalImagePrefix + "redis": "redis:7",
+			webhook.AnnotationMutatedBy:                     "docker.io is default",
+		}, patches[1].Value)
+
+		decisions, err := repo.GetDecisions(repoapi.DecisionFilter{Mode: repoapi.ModeWebhookMutate})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+		require.Equal(t, "redis", decisions[0].Container)
+		require.Equal(t, "docker.io is default", decisions[0].Rule)
+	})
+
+	// errors never end up as rule names
+	body := metricshelpers.Scrape(t)
+	require.NotContains(t, body, engine.ErrBadImageReference.Error())
+}
+
+func TestHandlers_Exclusions(t *testing.T) {
+	exclusions, err := webhook.NewExclusionsFromFile(path.Join("..", "..", "testdata", "rules.yaml"))
+	require.NoError(t, err)
+
+	repo := helpers.NewTestRepo(t)
+	r, _ := newTestRouter(t, []engine.Rule{defaultRegistry, noLatest}, routerOptions{repo: repo, exclusions: exclusions})
+
+	newReview := func(t *testing.T, namespace string, labels map[string]string, user authenticationv1.UserInfo) *admissionv1.AdmissionReview {
+		t.Helper()
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Labels: labels},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "nginx", Image: "nginx:latest"}},
+			},
+		}
+
+		review := newAdmissionReview(t, pod)
+		review.Request.Namespace = namespace
+		review.Request.UserInfo = user
+		return review
+	}
+
+	tests := []struct {
+		name   string
+		review *admissionv1.AdmissionReview
+		reason string
+	}{
+		{
+			"by namespace",
+			newReview(t, "kube-system", nil, authenticationv1.UserInfo{}),
+			"excluded by namespace 'kube-system'",
+		},
+		{
+			"by label selector",
+			newReview(t, "default", map[string]string{"kiw.io/exclude": "true"}, authenticationv1.UserInfo{}),
+			"excluded by label selector 'kiw.io/exclude=true'",
+		},
+		{
+			"by username",
+			newReview(t, "default", nil, authenticationv1.UserInfo{Username: "system:serviceaccount:ops:break-glass"}),
+			"excluded by username 'system:serviceaccount:ops:break-glass'",
+		},
+		{
+			"by group",
+			newReview(t, "default", nil, authenticationv1.UserInfo{Groups: []string{"system:authenticated", "system:masters"}}),
+			"excluded by group 'system:masters'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("Excluded "+tt.name, func(t *testing.T) {
+			resp := makeReviewRequest(t, r, "mutate", tt.review)
+			require.True(t, resp.Response.Allowed)
+			require.Empty(t, resp.Response.Patch)
+
+			resp = makeReviewRequest(t, r, "validate", tt.review)
+			require.True(t, resp.Response.Allowed)
+
+			// excluded requests are still recorded
+			decisions, err := repo.GetDecisions(repoapi.DecisionFilter{Namespace: tt.review.Request.Namespace, Verdict: repoapi.VerdictExcluded, Limit: 2})
+			require.NoError(t, err)
+			require.Len(t, decisions, 2)
+			for _, decision := range decisions {
+				require.Equal(t, "nginx:latest", decision.Image)
+				require.Equal(t, tt.reason, decision.Reason)
+			}
+		})
+	}
+
+	t.Run("Not excluded", func(t *testing.T) {
+		review := newReview(t, "default", map[string]string{"kiw.io/exclude": "false"}, authenticationv1.UserInfo{Username: "alice"})
+
+		resp := makeReviewRequest(t, r, "validate", review)
+		require.False(t, resp.Response.Allowed)
 		require.Contains(t, resp.Response.Result.Message, "No Latest")
 	})
+
+	t.Run("Empty label selector", func(t *testing.T) {
+		_, err := webhook.NewExclusions(webhook.Exclusions{LabelSelectors: []string{" "}})
+		require.ErrorIs(t, err, webhook.ErrWrongLabelSelector)
+	})
+}
+
+func TestHandlers_BreakGlass(t *testing.T) {
+	rules := []engine.Rule{
+		noLatest,
+		{
+			Name: "Released apps",
+			ValidationRule: engine.ValidationRule{
+				Type:      engine.ValidateTypeSemVer,
+				ImageName: "app",
+				ImageTag:  ">= 1.0.0",
+				Allow:     true,
+			},
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	breakGlass := webhook.NewBreakGlass(webhook.BreakGlassConfig{Groups: []string{"incident-responders"}}, client)
+
+	repo := helpers.NewTestRepo(t)
+	r, _ := newTestRouter(t, rules, routerOptions{repo: repo, breakGlass: breakGlass})
+
+	newPod := func(justification string, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Annotations: map[string]string{webhook.AnnotationBreakGlass: justification},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: image}},
+			},
+		}
+	}
+
+	newReview := func(t *testing.T, justification string, image string, groups ...string) *admissionv1.AdmissionReview {
+		t.Helper()
+
+		review := newAdmissionReview(t, newPod(justification, image))
+		review.Request.Namespace = "default"
+		review.Request.UserInfo = authenticationv1.UserInfo{Username: "alice", Groups: groups}
+		return review
+	}
+
+	newUpdateReview := func(t *testing.T, oldPod, pod *corev1.Pod) *admissionv1.AdmissionReview {
+		t.Helper()
+
+		review := newUpdateAdmissionReview(t, oldPod, pod)
+		review.Request.Namespace = "default"
+		review.Request.UserInfo = authenticationv1.UserInfo{Username: "bob", Groups: []string{"developers"}}
+		return review
+	}
+
+	t.Run("Denial is bypassed", func(t *testing.T) {
+		resp := makeReviewRequest(t, r, "validate", newReview(t, "INC-42: patched image", "app:latest", "incident-responders"))
+		require.True(t, resp.Response.Allowed)
+		require.Len(t, resp.Response.Warnings, 1)
+		require.Contains(t, resp.Response.Warnings[0], "No Latest")
+
+		decisions, err := repo.GetDecisions(repoapi.DecisionFilter{Verdict: repoapi.VerdictBypassed})
+		require.NoError(t, err)
+		require.Len(t, decisions, 1)
+		require.Equal(t, "No Latest", decisions[0].Rule)
+		require.Equal(t, "break-glass by 'alice': INC-42: patched image", decisions[0].Reason)
+
+		events, err := client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, events.Items, 1)
+		require.Equal(t, "BreakGlass", events.Items[0].Reason)
+		require.Equal(t, corev1.EventTypeWarning, events.Items[0].Type)
+		require.Equal(t, "Pod", events.Items[0].InvolvedObject.Kind)
+		require.Equal(t, "app", events.Items[0].InvolvedObject.Name)
+		require.Contains(t, events.Items[0].Message, "INC-42: patched image")
+	})
+
+	t.Run("Nothing to bypass", func(t *testing.T) {
+		resp := makeReviewRequest(t, r, "validate", newReview(t, "INC-42: patched image", "app:1.0.1", "incident-responders"))
+		require.True(t, resp.Response.Allowed)
+		require.Empty(t, resp.Response.Warnings)
+	})
+
+	t.Run("User is not allowed", func(t *testing.T) {
+		resp := makeReviewRequest(t, r, "validate", newReview(t, "INC-42: patched image", "app:1.0.1", "developers"))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+	})
+
+	t.Run("Justification is mandatory", func(t *testing.T) {
+		for _, justification := range []string{"", "INC-42", "INC-42:", ": patched image"} {
+			resp := makeReviewRequest(t, r, "validate", newReview(t, justification, "app:latest", "incident-responders"))
+			require.False(t, resp.Response.Allowed)
+			require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassJustification.Error())
+		}
+	})
+
+	t.Run("Annotation is kept on UPDATE", func(t *testing.T) {
+		oldPod := newPod("INC-42: patched image", "app:latest")
+		pod := newPod("INC-42: patched image", "app:latest")
+		pod.Labels = map[string]string{"team": "web"}
+
+		resp := makeReviewRequest(t, r, "validate", newUpdateReview(t, oldPod, pod))
+		require.True(t, resp.Response.Allowed)
+		require.Empty(t, resp.Response.Warnings)
+
+		// a new image would be admitted only because of the annotation
+		pod.Spec.Containers[0].Image = "app:0.9.0"
+		resp = makeReviewRequest(t, r, "validate", newUpdateReview(t, oldPod, pod))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+
+		pod = newPod("INC-43: another patched image", "app:latest")
+		resp = makeReviewRequest(t, r, "validate", newUpdateReview(t, oldPod, pod))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+	})
+
+	t.Run("Pods created by controllers", func(t *testing.T) {
+		replicaSet := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-5d8f", Namespace: "default", UID: "5d8f"},
+			Spec: appsv1.ReplicaSetSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{webhook.AnnotationBreakGlass: "INC-42: patched image"},
+					},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "app", Image: "app:latest"}},
+					},
+				},
+			},
+		}
+		_, err := client.AppsV1().ReplicaSets("default").Create(context.Background(), replicaSet, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		controllerAccount := authenticationv1.UserInfo{
+			Username: "system:serviceaccount:kube-system:replicaset-controller",
+			Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:kube-system"},
+		}
+
+		newOwnedReview := func(t *testing.T, justification string, image string, owner *appsv1.ReplicaSet, user ...authenticationv1.UserInfo) *admissionv1.AdmissionReview {
+			t.Helper()
+
+			pod := newPod(justification, image)
+			pod.OwnerReferences = []metav1.OwnerReference{
+				*metav1.NewControllerRef(owner, appsv1.SchemeGroupVersion.WithKind("ReplicaSet")),
+			}
+
+			review := newAdmissionReview(t, pod)
+			review.Request.Namespace = "default"
+			review.Request.UserInfo = controllerAccount
+			if len(user) > 0 {
+				review.Request.UserInfo = user[0]
+			}
+			return review
+		}
+
+		resp := makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-42: patched image", "app:1.0.1", replicaSet))
+		require.True(t, resp.Response.Allowed)
+		require.Empty(t, resp.Response.Warnings)
+
+		resp = makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-42: patched image", "app:latest", replicaSet))
+		require.True(t, resp.Response.Allowed)
+		require.Len(t, resp.Response.Warnings, 1)
+		require.Contains(t, resp.Response.Warnings[0], "No Latest")
+
+		// the annotation differs from the owner or the owner is another object
+		resp = makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-43: another patched image", "app:latest", replicaSet))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+
+		recreated := replicaSet.DeepCopy()
+		recreated.UID = "6e9a"
+		resp = makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-42: patched image", "app:latest", recreated))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+
+		// images which are not in the template of the owner are not bypassed
+		resp = makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-42: patched image", "app:0.9.0", replicaSet))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+
+		// ordinary users can't forge the owner reference, neither to add the annotation nor to bypass denials
+		bob := authenticationv1.UserInfo{Username: "bob", Groups: []string{"developers"}}
+		for _, image := range []string{"app:1.0.1", "app:latest"} {
+			resp = makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-42: patched image", image, replicaSet, bob))
+			require.False(t, resp.Response.Allowed)
+			require.Contains(t, resp.Response.Result.Message, webhook.ErrBreakGlassNotAllowed.Error())
+		}
+
+		// only the controller of the owner kind creates objects from its template
+		jobController := authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:job-controller"}
+		resp = makeReviewRequest(t, r, "validate", newOwnedReview(t, "INC-42: patched image", "app:latest", replicaSet, jobController))
+		require.False(t, resp.Response.Allowed)
+	})
+}
+
+// errUnreachable is a transport error, as the inspector returns it for a registry which is down.
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+type failingInspector struct{}
+
+func (failingInspector) GetDigests(context.Context, string) (engine.Digests, error) {
+	return engine.Digests{}, errUnreachable
+}
+
+func TestHandlers_RegistryFailure(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	err := helpers.PrepareRollingTags(repo)
+	require.NoError(t, err)
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "controller", Image: "k8s-image-warden-controller:latest"},
+			},
+		},
+	}
+
+	newRouter := func(t *testing.T, policy engine.RegistryFailurePolicy) *gin.Engine {
+		t.Helper()
+
+		rules := []engine.Rule{
+			{
+				Name: "No Rolling tags",
+				ValidationRule: engine.ValidationRule{
+					Type:              engine.ValidateTypeRollingTag,
+					Allow:             false,
+					OnRegistryFailure: policy,
+				},
+			},
+		}
+
+		r, _ := newTestRouter(t, rules, routerOptions{repo: repo, inspector: failingInspector{}})
+		return r
+	}
+
+	t.Run("Warn allows with warning", func(t *testing.T) {
+		resp := makeReviewRequest(t, newRouter(t, engine.RegistryFailureWarn), "validate", newAdmissionReview(t, pod))
+		require.True(t, resp.Response.Allowed)
+		require.Len(t, resp.Response.Warnings, 1)
+		require.Contains(t, resp.Response.Warnings[0], "k8s-image-warden-controller:latest")
+		require.Contains(t, resp.Response.Warnings[0], "allowed with warning by registry failure policy")
+	})
+
+	t.Run("Deny explains the rejection", func(t *testing.T) {
+		resp := makeReviewRequest(t, newRouter(t, engine.RegistryFailureDeny), "validate", newAdmissionReview(t, pod))
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, "No Rolling tags")
+		require.Contains(t, resp.Response.Result.Message, "denied by registry failure policy")
+	})
+}
+
+func TestHandlers_Shadow(t *testing.T) {
+	released := engine.Rule{
+		Name: "Released nginx",
+		ValidationRule: engine.ValidationRule{
+			Type:      engine.ValidateTypeSemVer,
+			ImageName: `docker\.io/nginx`,
+			ImageTag:  ">= 1.0.0",
+			Allow:     true,
+		},
+	}
+
+	rules := []engine.Rule{
+		{
+			Name: "Latest is allowed",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeLatest,
+				Allow: true,
+			},
+		},
+		released,
+	}
+
+	shadow, err := engine.NewEngine(nil, nil, []engine.Rule{noLatest, released})
+	require.NoError(t, err)
+
+	repo := helpers.NewTestRepo(t)
+	r, ruleEngine := newTestRouter(t, rules, routerOptions{repo: repo})
+	ruleEngine.SetShadow(shadow)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "latest", Image: "docker.io/nginx:latest"},
+				{Name: "pinned", Image: "docker.io/nginx:1.25"},
+			},
+		},
+	}
+
+	// the shadow rules would deny, but the response follows the active rules
+	resp := makeReviewRequest(t, r, "validate", newAdmissionReview(t, pod))
+	require.True(t, resp.Response.Allowed)
+	require.Empty(t, resp.Response.Warnings)
+
+	decisions, err := repo.GetDecisions(repoapi.DecisionFilter{ShadowDiff: true})
+	require.NoError(t, err)
+	require.Len(t, decisions, 1)
+	require.Equal(t, "docker.io/nginx:latest", decisions[0].Image)
+	require.Equal(t, repoapi.VerdictAllowed, decisions[0].Verdict)
+	require.Equal(t, repoapi.VerdictDenied, decisions[0].ShadowVerdict)
+	require.Equal(t, "No Latest", decisions[0].ShadowRule)
+
+	decisions, err = repo.GetDecisions(repoapi.DecisionFilter{Image: "docker.io/nginx:1.25"})
+	require.NoError(t, err)
+	require.Len(t, decisions, 1)
+	require.Equal(t, repoapi.VerdictAllowed, decisions[0].ShadowVerdict)
+	require.Equal(t, "Released nginx", decisions[0].ShadowRule)
+}
+
+func TestHandlers_ImagePolicy(t *testing.T) {
+	rules := []engine.Rule{
+		{
+			Name: "Latest with ticket",
+			ValidationRule: engine.ValidationRule{
+				Type:        engine.ValidateTypeLatest,
+				Allow:       true,
+				Annotations: map[string]string{"mycluster.image-policy.k8s.io/ticket": ""},
+			},
+		},
+		noLatest,
+		{
+			Name: "Released nginx",
+			ValidationRule: engine.ValidationRule{
+				Type:      engine.ValidateTypeSemVer,
+				ImageName: `docker\.io/nginx`,
+				ImageTag:  ">= 1.0.0",
+				Allow:     true,
+			},
+		},
+	}
+
+	repo := helpers.NewTestRepo(t)
+	r, ruleEngine := newTestRouter(t, rules, routerOptions{repo: repo})
+	ruleEngine.SetVerdictCache(10, time.Minute)
+
+	newReview := func(annotations map[string]string, images ...string) *imagepolicyv1alpha1.ImageReview {
+		review := &imagepolicyv1alpha1.ImageReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "imagepolicy.k8s.io/v1alpha1", Kind: "ImageReview"},
+			Spec:     imagepolicyv1alpha1.ImageReviewSpec{Namespace: "default", Annotations: annotations},
+		}
+		for _, image := range images {
+			review.Spec.Containers = append(review.Spec.Containers, imagepolicyv1alpha1.ImageReviewContainerSpec{Image: image})
+		}
+		return review
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		resp := makeImageReviewRequest(t, r, newReview(nil, "docker.io/nginx:1.25"))
+		require.Equal(t, "ImageReview", resp.Kind)
+		require.True(t, resp.Status.Allowed)
+		require.Empty(t, resp.Status.Reason)
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		resp := makeImageReviewRequest(t, r, newReview(nil, "docker.io/nginx:1.25", "docker.io/nginx:latest"))
+		require.False(t, resp.Status.Allowed)
+		require.Equal(t, "'docker.io/nginx:latest' is not allowed by rule 'No Latest'", resp.Status.Reason)
+	})
+
+	t.Run("Annotations feed the rules", func(t *testing.T) {
+		annotations := map[string]string{"mycluster.image-policy.k8s.io/ticket": "INC-1234"}
+		resp := makeImageReviewRequest(t, r, newReview(annotations, "docker.io/nginx:latest"))
+		require.True(t, resp.Status.Allowed)
+
+		// the cached verdict of the annotated review isn't used without annotations
+		resp = makeImageReviewRequest(t, r, newReview(nil, "docker.io/nginx:latest"))
+		require.False(t, resp.Status.Allowed)
+	})
+
+	decisions, err := repo.GetDecisions(repoapi.DecisionFilter{Mode: repoapi.ModeImagePolicy, Verdict: repoapi.VerdictDenied})
+	require.NoError(t, err)
+	require.Len(t, decisions, 2)
+	require.Equal(t, "default", decisions[0].Namespace)
+	require.Equal(t, "docker.io/nginx:latest", decisions[0].Image)
+	require.Equal(t, "No Latest", decisions[0].Rule)
+
+	body := metricshelpers.Scrape(t)
+	require.Contains(t, body, `kiw_webhook_requests_total{verdict="denied",webhook="imagepolicy"} 2`)
+}
+
+// credentialsInspector records credentials the keychain gives for the admitted pod.
+type credentialsInspector struct {
+	keychain *registry.Keychain
+	auth     *types.DockerAuthConfig
+}
+
+func (i *credentialsInspector) GetDigests(ctx context.Context, _ string) (engine.Digests, error) {
+	auth, err := i.keychain.Credentials(ctx, "docker.io")
+	if err != nil {
+		return engine.Digests{}, err
+	}
+	i.auth = auth
+	return engine.Digests{}, errUnreachable
+}
+
+func TestHandlers_PullSecrets(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	err := helpers.PrepareRollingTags(repo)
+	require.NoError(t, err)
+
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: "apps"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+			`{"auths": {"docker.io": {"username": "apps", "password": "secret"}}}`)},
+	})
+	inspector := &credentialsInspector{keychain: registry.NewKeychain(client)}
+
+	rules := []engine.Rule{
+		{
+			Name: "No Rolling tags",
+			ValidationRule: engine.ValidationRule{
+				Type:              engine.ValidateTypeRollingTag,
+				Allow:             false,
+				OnRegistryFailure: engine.RegistryFailureAllow,
+			},
+		},
+	}
+
+	r, _ := newTestRouter(t, rules, routerOptions{repo: repo, inspector: inspector})
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "hub"}},
+			Containers: []corev1.Container{
+				{Name: "controller", Image: "k8s-image-warden-controller:latest"},
+			},
+		},
+	}
+
+	review := newAdmissionReview(t, pod)
+	review.Request.Namespace = "apps"
+
+	resp := makeReviewRequest(t, r, "validate", review)
+	require.True(t, resp.Response.Allowed)
+	require.Equal(t, &types.DockerAuthConfig{Username: "apps", Password: "secret"}, inspector.auth)
+}
+
+// privateInspector gives the digest of the image to credentials of its owner only.
+type privateInspector struct {
+	keychain *registry.Keychain
+	calls    int
+}
+
+func (i *privateInspector) GetDigests(ctx context.Context, _ string) (engine.Digests, error) {
+	i.calls++
+	auth, err := i.keychain.Credentials(ctx, "docker.io")
+	if err != nil {
+		return engine.Digests{}, err
+	}
+	if auth == nil || auth.Username != "apps" {
+		return engine.Digests{}, errors.New("reading manifest latest in docker.io/library/k8s-image-warden-controller: unauthorized")
+	}
+	return engine.Digests{Manifests: []string{helpers.Digest2}}, nil
+}
+
+func TestHandlers_PullSecretsCache(t *testing.T) {
+	repo := helpers.NewTestRepo(t)
+
+	err := helpers.PrepareRollingTags(repo)
+	require.NoError(t, err)
+
+	newSecret := func(namespace string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "hub", Namespace: namespace},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+				`{"auths": {"docker.io": {"username": "` + namespace + `", "password": "secret"}}}`)},
+		}
+	}
+
+	keychain := registry.NewKeychain(fake.NewSimpleClientset(newSecret("apps"), newSecret("team")))
+	inspector := &privateInspector{keychain: keychain}
+
+	rules := []engine.Rule{
+		{
+			Name: "No Rolling tags",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeRollingTag,
+				Allow: false,
+			},
+		},
+		{
+			Name: "Latest is allowed",
+			ValidationRule: engine.ValidationRule{
+				Type:  engine.ValidateTypeLatest,
+				Allow: true,
+			},
+		},
+	}
+
+	cachedInspector := engine.NewCachedImageInspector(inspector, keychain, 10, time.Minute)
+
+	// the shadow rules are the same, so their verdicts follow the credentials too
+	shadow, err := engine.NewEngine(repo, cachedInspector, rules)
+	require.NoError(t, err)
+	shadow.SetVerdictCache(10, time.Minute)
+	shadow.SetKeychain(keychain)
+
+	r, ruleEngine := newTestRouter(t, rules, routerOptions{repo: repo, inspector: cachedInspector})
+	ruleEngine.SetVerdictCache(10, time.Minute)
+	ruleEngine.SetKeychain(keychain)
+	ruleEngine.SetShadow(shadow)
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "hub"}},
+			Containers: []corev1.Container{
+				{Name: "controller", Image: "k8s-image-warden-controller:latest"},
+			},
+		},
+	}
+
+	validate := func(t *testing.T, namespace string) *admissionv1.AdmissionReview {
+		t.Helper()
+
+		review := newAdmissionReview(t, pod)
+		review.Request.Namespace = namespace
+		return makeReviewRequest(t, r, "validate", review)
+	}
+
+	// only credentials of apps reveal that the tag is rolling
+	for i := 0; i < 2; i++ {
+		resp := validate(t, "apps")
+		require.False(t, resp.Response.Allowed)
+		require.Contains(t, resp.Response.Result.Message, "No Rolling tags")
+
+		resp = validate(t, "team")
+		require.True(t, resp.Response.Allowed)
+	}
+
+	// each namespace asked the registry with its own credentials once, failed lookups are not cached
+	// and the shadow rules ask again for team
+	require.Equal(t, 3, inspector.calls)
+
+	decisions, err := repo.GetDecisions(repoapi.DecisionFilter{})
+	require.NoError(t, err)
+	require.Len(t, decisions, 4)
+	for _, decision := range decisions {
+		require.Equal(t, decision.Verdict, decision.ShadowVerdict, decision.Namespace)
+		require.Equal(t, decision.Rule, decision.ShadowRule, decision.Namespace)
+	}
+
+	decisions, err = repo.GetDecisions(repoapi.DecisionFilter{ShadowDiff: true})
+	require.NoError(t, err)
+	require.Empty(t, decisions)
+}
+
+// routerOptions are optional dependencies of the handlers, the repo is used by the engine as well.
+type routerOptions struct {
+	repo       repoapi.Store
+	inspector  engine.ImageInspector
+	exclusions *webhook.Exclusions
+	breakGlass *webhook.BreakGlass
+}
+
+// newTestRouter serves the webhook handlers with the engine of the rules, the engine is returned to be set up further.
+func newTestRouter(t *testing.T, rules []engine.Rule, opts routerOptions) (*gin.Engine, *engine.Engine) {
+	t.Helper()
+
+	ruleEngine, err := engine.NewEngine(opts.repo, opts.inspector, rules)
+	require.NoError(t, err)
+
+	r := gin.Default()
+	webhook.RegisterHandlers(r, ruleEngine, opts.exclusions, opts.breakGlass, opts.repo)
+
+	return r, ruleEngine
+}
+
+func newAdmissionReview(t *testing.T, pod *corev1.Pod) *admissionv1.AdmissionReview {
+	t.Helper()
+
+	return newObjectAdmissionReview(t, "Pod", pod.Name, pod)
+}
+
+func newObjectAdmissionReview(t *testing.T, kind, name string, object interface{}) *admissionv1.AdmissionReview {
+	t.Helper()
+
+	raw, err := json.Marshal(object)
+	require.NoError(t, err)
+
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AdmissionReview",
+			APIVersion: "admission.k8s.io/v1",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uidValue",
+			Kind:      metav1.GroupVersionKind{Kind: kind},
+			Name:      name,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func newUpdateAdmissionReview(t *testing.T, oldPod, pod *corev1.Pod) *admissionv1.AdmissionReview {
+	t.Helper()
+
+	review := newAdmissionReview(t, pod)
+
+	raw, err := json.Marshal(oldPod)
+	require.NoError(t, err)
+
+	review.Request.Operation = admissionv1.Update
+	review.Request.OldObject = runtime.RawExtension{Raw: raw}
+
+	return review
 }
 
 func makeRequst(t *testing.T, r *gin.Engine, action, filename string) *admissionv1.AdmissionReview {
@@ -74,8 +1273,14 @@ func makeRequst(t *testing.T, r *gin.Engine, action, filename string) *admission
 	err = json.Unmarshal(file, &review)
 	require.NoError(t, err)
 
+	return makeReviewRequest(t, r, action, &review)
+}
+
+func makeReviewRequest(t *testing.T, r *gin.Engine, action string, review *admissionv1.AdmissionReview) *admissionv1.AdmissionReview {
+	t.Helper()
+
 	var b bytes.Buffer
-	err = json.NewEncoder(&b).Encode(review)
+	err := json.NewEncoder(&b).Encode(review)
 	require.NoError(t, err)
 
 	w := httptest.NewRecorder()
@@ -90,3 +1295,23 @@ func makeRequst(t *testing.T, r *gin.Engine, action, filename string) *admission
 
 	return &resp
 }
+
+func makeImageReviewRequest(t *testing.T, r *gin.Engine, review *imagepolicyv1alpha1.ImageReview) *imagepolicyv1alpha1.ImageReview {
+	t.Helper()
+
+	var b bytes.Buffer
+	err := json.NewEncoder(&b).Encode(review)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/imagepolicy", &b)
+	req.Header.Add("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	var resp imagepolicyv1alpha1.ImageReview
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	require.NoError(t, err)
+
+	return &resp
+}
@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surik/k8s-image-warden/pkg/engine"
+	"github.com/surik/k8s-image-warden/pkg/repo"
+	imagepolicyv1alpha1 "k8s.io/api/imagepolicy/v1alpha1"
+)
+
+// imagePolicyHandler is the backend of the ImagePolicyWebhook admission plugin. Images are validated
+// by the same rules as in the validating webhook, annotations of the review are available to the rules.
+func imagePolicyHandler(engine *engine.Engine, repo repo.Store, c *gin.Context) {
+	verdict := verdictError
+	defer func(start time.Time) {
+		observeRequest(webhookImagePolicy, verdict, start)
+	}(time.Now())
+
+	var review imagepolicyv1alpha1.ImageReview
+	if err := c.ShouldBindJSON(&review); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	log.Printf("image policy for %d containers in namespace %s\n", len(review.Spec.Containers), review.Spec.Namespace)
+
+	containers := make([]podContainer, len(review.Spec.Containers))
+	for i, container := range review.Spec.Containers {
+		containers[i] = podContainer{Image: container.Image}
+	}
+
+	verdicts := validate(imageReviewContext(c, &review), engine, containers)
+
+	decisions := imagePolicyDecisions(&review, verdicts)
+	storeDecisions(repo, decisions)
+	observeDecisions(webhookImagePolicy, decisions)
+
+	status := imagepolicyv1alpha1.ImageReviewStatus{Allowed: true}
+	if violations := getViolations(verdicts); len(violations) > 0 {
+		status = imagepolicyv1alpha1.ImageReviewStatus{Allowed: false, Reason: imageViolationsMessage(violations)}
+	}
+
+	verdict = verdictAllowed
+	if !status.Allowed {
+		verdict = verdictDenied
+	}
+
+	c.JSON(http.StatusOK, imagepolicyv1alpha1.ImageReview{TypeMeta: review.TypeMeta, Status: status})
+}
+
+// imageReviewContext makes annotations of the review available to the rules. The review
+// has no pull secrets, so only the registry auth file of the controller is used.
+func imageReviewContext(ctx context.Context, review *imagepolicyv1alpha1.ImageReview) context.Context {
+	return engine.WithAnnotations(ctx, review.Spec.Annotations)
+}
+
+// imageViolationsMessage doesn't mention containers, as the review has only their images.
+func imageViolationsMessage(violations []verdict) string {
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		messages[i] = fmt.Sprintf("'%s' is not allowed by rule '%s'", v.Image, v.Rule)
+		if v.Reason != "" {
+			messages[i] += " (" + v.Reason + ")"
+		}
+	}
+
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/surik/k8s-image-warden/pkg/metrics"
+	"github.com/surik/k8s-image-warden/pkg/repo"
+)
+
+// webhook names used as the metrics label
+const (
+	webhookMutate      = "mutate"
+	webhookValidate    = "validate"
+	webhookImagePolicy = "imagepolicy"
+)
+
+// request verdicts used as the metrics label, verdictError is used when the admission review can't be read
+const (
+	verdictAllowed   = repo.VerdictAllowed
+	verdictDenied    = repo.VerdictDenied
+	verdictMutated   = repo.VerdictMutated
+	verdictUnchanged = repo.VerdictUnchanged
+	verdictExcluded  = repo.VerdictExcluded
+	verdictBypassed  = repo.VerdictBypassed
+	verdictError     = "error"
+)
+
+func observeRequest(webhook, verdict string, start time.Time) {
+	metrics.WebhookRequests.WithLabelValues(webhook, verdict).Inc()
+	metrics.WebhookRequestDuration.WithLabelValues(webhook, verdict).Observe(time.Since(start).Seconds())
+}
+
+func observeDecisions(webhook string, decisions []repo.Decision) {
+	for _, decision := range decisions {
+		metrics.WebhookDecisions.WithLabelValues(webhook, decision.Verdict, decision.Rule).Inc()
+	}
+}
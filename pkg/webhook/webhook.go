@@ -2,60 +2,72 @@ package webhook
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/surik/k8s-image-warden/pkg/engine"
+	"github.com/surik/k8s-image-warden/pkg/health"
+	"github.com/surik/k8s-image-warden/pkg/repo"
 
 	"github.com/gin-gonic/gin"
 )
 
+// CertificateProvider gives the current serving certificate, so it can be renewed without restart.
+type CertificateProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
 type WebhookServer struct {
-	endpoint string
-	certFile string
-	keyFile  string
-	r        *gin.Engine
-	srv      *http.Server
+	endpoint     string
+	certificates CertificateProvider
+	r            *gin.Engine
+	srv          *http.Server
 }
 
-func NewWebhookServer(endpoint, certFile, keyFile string) (*WebhookServer, error) {
+// NewWebhookServer returns server which serves HTTPS with certificates of the provider or HTTP if there is no provider.
+// Readiness of the controller is served on /readyz and liveness on /healthz.
+func NewWebhookServer(endpoint string, certificates CertificateProvider, readiness *health.Checker) (*WebhookServer, error) {
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 
 	r := gin.New()
 	r.Use(gin.Recovery())
 
+	r.GET("/healthz", gin.WrapH(health.LivenessHandler()))
+	r.GET("/readyz", gin.WrapH(readiness.Handler()))
+
 	srv := &http.Server{
 		Addr:    endpoint,
 		Handler: r,
 	}
 
+	if certificates != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.GetCertificate,
+		}
+	}
+
 	return &WebhookServer{
-		endpoint: endpoint,
-		certFile: certFile,
-		keyFile:  keyFile,
-		r:        r,
-		srv:      srv,
+		endpoint:     endpoint,
+		certificates: certificates,
+		r:            r,
+		srv:          srv,
 	}, nil
 }
 
-func (wh *WebhookServer) Run(ctx context.Context, engine *engine.Engine) {
-	wh.r.POST("/mutate", func(c *gin.Context) {
-		mutateHandler(engine, c)
-	})
-
-	wh.r.POST("/validate", func(c *gin.Context) {
-		validateHandler(engine, c)
-	})
+func (wh *WebhookServer) Run(ctx context.Context, engine *engine.Engine, exclusions *Exclusions, breakGlass *BreakGlass, repo repo.Store) {
+	registerHandlers(wh.r, engine, exclusions, breakGlass, repo)
 
 	log.Printf("Listening webhook on %s", wh.endpoint)
-	if wh.certFile == "" || wh.keyFile == "" {
+	if wh.certificates == nil {
 		if err := wh.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			panic(err)
 		}
 	} else {
-		if err := wh.srv.ListenAndServeTLS(wh.certFile, wh.keyFile); err != nil && err != http.ErrServerClosed {
+		if err := wh.srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			panic(err)
 		}
 	}
@@ -69,3 +81,17 @@ func (wh *WebhookServer) Stop() {
 	}
 	log.Println("Webhook Server was shutdown")
 }
+
+func registerHandlers(r gin.IRoutes, engine *engine.Engine, exclusions *Exclusions, breakGlass *BreakGlass, repo repo.Store) {
+	r.POST("/mutate", func(c *gin.Context) {
+		mutateHandler(engine, exclusions, repo, c)
+	})
+
+	r.POST("/validate", func(c *gin.Context) {
+		validateHandler(engine, exclusions, breakGlass, repo, c)
+	})
+
+	r.POST("/imagepolicy", func(c *gin.Context) {
+		imagePolicyHandler(engine, repo, c)
+	})
+}